@@ -0,0 +1,115 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/soniah/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// How often expired PDUs are dropped from the cache.
+const pduCachePurgeInterval = time.Minute
+
+var (
+	pduCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snmp_pdu_cache_lookups_total",
+			Help: "Lookups of the cached PDUs of a subtree or OID with a cache_ttl, by whether they were cached.",
+		},
+		[]string{"result"},
+	)
+
+	// PDUs of subtrees and OIDs with a cache_ttl, across scrapes.
+	targetPDUs = newPDUCache()
+)
+
+func init() {
+	pduCacheLookups.WithLabelValues("hit")
+	pduCacheLookups.WithLabelValues("miss")
+	prometheus.MustRegister(pduCacheLookups)
+}
+
+// pduKey identifies a subtree or OID of a target. What a target returns
+// may depend on the version and the credentials, such as the context.
+type pduKey struct {
+	target  string
+	version int
+	auth    config.Auth
+	oid     string
+}
+
+type pduEntry struct {
+	pdus    []gosnmp.SnmpPDU
+	expires time.Time
+}
+
+// pduCache keeps the PDUs of subtrees and OIDs that change rarely, such as
+// the names of interfaces, so that scrapes fetch them only once they expire.
+type pduCache struct {
+	mtx     sync.Mutex
+	entries map[pduKey]pduEntry
+	purged  time.Time
+}
+
+func newPDUCache() *pduCache {
+	return &pduCache{entries: map[pduKey]pduEntry{}}
+}
+
+// get returns the PDUs cached for the subtree or OID of the target, and
+// whether there were any that have not expired. Without a ttl nothing is
+// cached.
+func (c *pduCache) get(target string, wp config.WalkParams, oid string, ttl time.Duration) ([]gosnmp.SnmpPDU, bool) {
+	if ttl <= 0 {
+		return nil, false
+	}
+	key := pduKey{target, wp.Version, wp.Auth, oid}
+	c.mtx.Lock()
+	entry, ok := c.entries[key]
+	if ok && !time.Now().Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mtx.Unlock()
+	if !ok {
+		pduCacheLookups.WithLabelValues("miss").Inc()
+		return nil, false
+	}
+	pduCacheLookups.WithLabelValues("hit").Inc()
+	return entry.pdus, true
+}
+
+// put caches the PDUs of the subtree or OID of the target for ttl. The PDUs
+// must not be modified afterwards.
+func (c *pduCache) put(target string, wp config.WalkParams, oid string, pdus []gosnmp.SnmpPDU, ttl time.Duration) {
+	if ttl <= 0 {
+		return
+	}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(c.purged) >= pduCachePurgeInterval {
+		for k, entry := range c.entries {
+			if !now.Before(entry.expires) {
+				delete(c.entries, k)
+			}
+		}
+		c.purged = now
+	}
+	c.entries[pduKey{target, wp.Version, wp.Auth, oid}] = pduEntry{pdus: pdus, expires: now.Add(ttl)}
+}
@@ -14,15 +14,21 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/golang/protobuf/proto"
 	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/prometheus/common/log"
 	"github.com/soniah/gosnmp"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/prometheus/snmp_exporter/config"
 )
@@ -49,54 +55,124 @@ func oidToList(oid string) []int {
 	return result
 }
 
-func ScrapeTarget(target string, config *config.Module) ([]gosnmp.SnmpPDU, error) {
-	// Set the options.
-	snmp := gosnmp.GoSNMP{}
-	snmp.MaxRepetitions = config.WalkParams.MaxRepetitions
-	// User specifies timeout of each retry attempt but GoSNMP expects total timeout for all attemtps.
-	snmp.Retries = config.WalkParams.Retries
-	snmp.Timeout = config.WalkParams.Timeout * time.Duration(snmp.Retries)
+// ScrapeResults is what a scrape of a target returned.
+type ScrapeResults struct {
+	PDUs []gosnmp.SnmpPDU
+	// Truncated is set if the context ended before all OIDs were fetched.
+	Truncated bool
+	// The outcome of walking each subtree, in the order of the module.
+	Subtrees []SubtreeResult
+	// How many of the PDUs came from the cache rather than the target.
+	CachedPDUs int
+}
 
-	snmp.Target = target
-	snmp.Port = 161
-	if host, port, err := net.SplitHostPort(target); err == nil {
-		snmp.Target = host
-		p, err := strconv.Atoi(port)
-		if err != nil {
-			return nil, fmt.Errorf("Error converting port number to int for target %s: %s", target, err)
+// SubtreeResult is the outcome of walking one subtree.
+type SubtreeResult struct {
+	Oid string
+	// Walked is set if the whole subtree was walked.
+	Walked bool
+	// Subtrees walked together share the duration.
+	Duration time.Duration
+}
+
+// ScrapeTarget gets and walks the OIDs of the module. When ctx ends the
+// remaining OIDs are skipped, and the results so far are returned as
+// truncated. If the target did not respond by then the scrape fails with a
+// timeout.
+//
+// With a walk_concurrency above 1 the subtrees are walked in parallel over
+// several sessions, as far as the limit on sessions per target allows.
+//
+// With partial_results the scrape goes on when walking a subtree fails, and
+// only fails if no subtree could be walked. The PDUs of failed subtrees are
+// dropped.
+//
+// SNMPv3 sessions start from the engine cached for the target, and the
+// engine the scrape ends with is cached for the next.
+//
+// Subtrees and OIDs read only by metrics and lookups with a cache_ttl are
+// taken from the cache while they are fresh, and cached when fetched. A
+// subtree taken from the cache counts as walked.
+func ScrapeTarget(ctx context.Context, target string, config *config.Module) (results ScrapeResults, err error) {
+	results.Subtrees = make([]SubtreeResult, len(config.Walk))
+	for i, oid := range config.Walk {
+		results.Subtrees[i].Oid = oid
+	}
+	getOids := []string{}
+	getTTLs := map[string]time.Duration{}
+	for _, oid := range config.Get {
+		ttl := config.CacheTTL(oid)
+		if pdus, ok := targetPDUs.get(target, config.WalkParams, oid, ttl); ok {
+			results.PDUs = append(results.PDUs, pdus...)
+			results.CachedPDUs += len(pdus)
+			continue
 		}
-		snmp.Port = uint16(p)
+		getOids = append(getOids, oid)
+		getTTLs[oid] = ttl
+	}
+	subtreeTTLs := make([]time.Duration, len(config.Walk))
+	toWalk := []int{}
+	for i, subtree := range config.Walk {
+		subtreeTTLs[i] = config.CacheTTL(subtree)
+		if pdus, ok := targetPDUs.get(target, config.WalkParams, subtree, subtreeTTLs[i]); ok {
+			results.PDUs = append(results.PDUs, pdus...)
+			results.CachedPDUs += len(pdus)
+			results.Subtrees[i].Walked = true
+			continue
+		}
+		toWalk = append(toWalk, i)
+	}
+	// Nothing left to fetch from the target.
+	if len(getOids) == 0 && len(toWalk) == 0 {
+		return results, nil
 	}
 
-	// Configure auth.
-	config.WalkParams.ConfigureSNMP(&snmp)
-
-	// Do the actual walk.
-	err := snmp.Connect()
+	snmp, err := newSession(ctx, target, config)
 	if err != nil {
-		return nil, fmt.Errorf("Error connecting to target %s: %s", target, err)
+		return results, err
+	}
+	if snmp == nil {
+		return truncate(target, results, false)
 	}
 	defer snmp.Conn.Close()
+	defer func() {
+		targetEngines.update(target, config.WalkParams, snmp, err != nil, *engineTTL)
+	}()
+	targetSessions.add(target)
+	defer targetSessions.done(target)
 
-	result := []gosnmp.SnmpPDU{}
-	getOids := config.Get
 	maxOids := int(config.WalkParams.MaxRepetitions)
 	// Max Repetition can be 0, maxOids cannot. SNMPv1 can only report one OID error per call.
 	if maxOids == 0 || snmp.Version == gosnmp.Version1 {
 		maxOids = 1
 	}
+	maxOids = targetRequestSizes.limit(target, maxOids)
+	responded := false
 	for len(getOids) > 0 {
 		oids := len(getOids)
 		if oids > maxOids {
 			oids = maxOids
 		}
 
+		if !setTimeout(ctx, snmp, config) {
+			log.Debugf("Scrape of target %q ran out of time with %d OIDs left to get", snmp.Target, len(getOids))
+			return truncate(target, results, responded)
+		}
 		log.Debugf("Getting %d OIDs from target %q", oids, snmp.Target)
 		getStart := time.Now()
 		packet, err := snmp.Get(getOids[:oids])
+		if tooLarge(ctx, packet, err, oids, responded) {
+			maxOids = targetRequestSizes.shrink(target, oids)
+			log.Debugf("Response of target %q too large, retrying with %d OIDs", snmp.Target, maxOids)
+			continue
+		}
 		if err != nil {
-			return nil, fmt.Errorf("Error getting target %s: %s", snmp.Target, err)
+			if ctx.Err() != nil {
+				return truncate(target, results, responded)
+			}
+			return results, wrapError(err, "Error getting target %s", snmp.Target)
 		}
+		responded = true
 		log.Debugf("Get of %d OIDs completed in %s", oids, time.Since(getStart))
 		// SNMPv1 will return packet error for unsupported OIDs.
 		if packet.Error == gosnmp.NoSuchName && snmp.Version == gosnmp.Version1 {
@@ -104,38 +180,243 @@ func ScrapeTarget(target string, config *config.Module) ([]gosnmp.SnmpPDU, error
 			getOids = getOids[oids:]
 			continue
 		}
+		// A report the session could not recover from, such as wrong credentials.
+		if packet.PDUType == gosnmp.Report && len(packet.Variables) > 0 {
+			return results, reportError(snmp.Target, packet)
+		}
 		// Response received with errors.
-		// TODO: "stringify" gosnmp errors instead of showing error code.
 		if packet.Error != gosnmp.NoError {
-			return nil, fmt.Errorf("Error reported by target %s: Error Status %d", snmp.Target, packet.Error)
+			return results, statusError(snmp.Target, packet.Error)
 		}
-		for _, v := range packet.Variables {
+		for j, v := range packet.Variables {
+			var pdus []gosnmp.SnmpPDU
 			if v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance {
 				log.Debugf("OID %s not supported by target %s", v.Name, snmp.Target)
-				continue
+			} else {
+				results.PDUs = append(results.PDUs, v)
+				pdus = []gosnmp.SnmpPDU{v}
+			}
+			// The variables are in the order of the OIDs requested.
+			if j < oids {
+				targetPDUs.put(target, config.WalkParams, getOids[j], pdus, getTTLs[getOids[j]])
 			}
-			result = append(result, v)
 		}
 		getOids = getOids[oids:]
 	}
 
-	for _, subtree := range config.Walk {
-		var pdus []gosnmp.SnmpPDU
-		log.Debugf("Walking target %q subtree %q", snmp.Target, subtree)
-		walkStart := time.Now()
-		if snmp.Version == gosnmp.Version1 {
-			pdus, err = snmp.WalkAll(subtree)
-		} else {
-			pdus, err = snmp.BulkWalkAll(subtree)
+	// Subtrees that are siblings, such as the columns of a table, are walked
+	// together in lockstep. SNMPv1 has no GETBULK to do so.
+	maxGroup := gosnmp.MaxOids
+	if snmp.Version == gosnmp.Version1 {
+		maxGroup = 1
+	}
+	uncached := make([]string, len(toWalk))
+	for j, i := range toWalk {
+		uncached[j] = config.Walk[i]
+	}
+	groups := walkGroups(uncached, maxGroup)
+	for _, group := range groups {
+		for j := range group {
+			group[j] = toWalk[group[j]]
+		}
+	}
+
+	// Open as many more sessions as the module wants to walk in parallel,
+	// and the target has room for.
+	walkers := []*gosnmp.GoSNMP{snmp}
+	for len(walkers) < config.WalkParams.WalkConcurrency && len(walkers) < len(groups) {
+		if !targetSessions.tryAdd(target, *maxSessions) {
+			break
+		}
+		extra, err := newSession(ctx, target, config)
+		if err != nil || extra == nil {
+			targetSessions.done(target)
+			break
+		}
+		defer extra.Conn.Close()
+		defer targetSessions.done(target)
+		walkers = append(walkers, extra)
+	}
+
+	// Each walker takes the next group until none are left.
+	groupCh := make(chan []int, len(groups))
+	for _, group := range groups {
+		groupCh <- group
+	}
+	close(groupCh)
+	subtreePDUs := make([][]gosnmp.SnmpPDU, len(config.Walk))
+	failed := make([]bool, len(config.Walk))
+	var walkErr error
+	var walkErrMtx sync.Mutex
+	g, walkCtx := errgroup.WithContext(ctx)
+	for _, walker := range walkers {
+		walker := walker
+		g.Go(func() error {
+			for group := range groupCh {
+				subtrees := make([]string, len(group))
+				for j, i := range group {
+					subtrees[j] = config.Walk[i]
+				}
+				walkStart := time.Now()
+				pdus, err := walkSubtrees(walkCtx, walker, config, target, subtrees)
+				for j, i := range group {
+					subtreePDUs[i] = pdus[j]
+					results.Subtrees[i].Duration = time.Since(walkStart)
+				}
+				if err != nil {
+					// Out of time, or another walker failed.
+					if walkCtx.Err() != nil {
+						return nil
+					}
+					if !config.WalkParams.PartialResults {
+						return err
+					}
+					log.Infof("Error walking subtrees %v of target %s: %s", subtrees, target, err)
+					walkErrMtx.Lock()
+					if walkErr == nil {
+						walkErr = err
+					}
+					walkErrMtx.Unlock()
+					for _, i := range group {
+						subtreePDUs[i] = nil
+						failed[i] = true
+					}
+					continue
+				}
+				for _, i := range group {
+					results.Subtrees[i].Walked = true
+					targetPDUs.put(target, config.WalkParams, config.Walk[i], subtreePDUs[i], subtreeTTLs[i])
+				}
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return results, err
+	}
+	failures := 0
+	truncated := false
+	for i, pdus := range subtreePDUs {
+		results.PDUs = append(results.PDUs, pdus...)
+		if failed[i] {
+			failures++
+		} else if !results.Subtrees[i].Walked {
+			truncated = true
+		}
+	}
+	if failures > 0 && failures == len(config.Walk) {
+		return results, walkErr
+	}
+	if truncated {
+		log.Debugf("Scrape of target %q ran out of time walking subtrees", snmp.Target)
+		for _, i := range toWalk {
+			if results.Subtrees[i].Walked || len(subtreePDUs[i]) > 0 {
+				responded = true
+			}
 		}
+		return truncate(target, results, responded)
+	}
+	return results, nil
+}
+
+// truncate returns the results of a scrape that ran out of time as truncated
+// if the target responded to it, and fails it with a timeout if not.
+func truncate(target string, results ScrapeResults, responded bool) (ScrapeResults, error) {
+	if !responded {
+		return results, &scrapeError{
+			class: errorTimeout,
+			msg:   fmt.Sprintf("Scrape of target %s ran out of time before the target responded", target),
+		}
+	}
+	results.Truncated = true
+	return results, nil
+}
+
+// newSession connects to the target with the settings of the module. It
+// returns nil if ctx has already ended.
+func newSession(ctx context.Context, target string, config *config.Module) (*gosnmp.GoSNMP, error) {
+	// Set the options.
+	snmp := &gosnmp.GoSNMP{}
+	snmp.MaxRepetitions = config.WalkParams.MaxRepetitions
+	snmp.Retries = config.WalkParams.Retries
+
+	snmp.Target = target
+	snmp.Port = 161
+	if host, port, err := net.SplitHostPort(target); err == nil {
+		snmp.Target = host
+		p, err := strconv.Atoi(port)
 		if err != nil {
-			return nil, fmt.Errorf("Error walking target %s: %s", snmp.Target, err)
+			return nil, fmt.Errorf("Error converting port number to int for target %s: %s", target, err)
+		}
+		snmp.Port = uint16(p)
+	}
+
+	// Configure auth.
+	config.WalkParams.ConfigureSNMP(snmp)
+	targetEngines.restore(target, config.WalkParams, snmp, *engineTTL)
+
+	if !setTimeout(ctx, snmp, config) {
+		return nil, nil
+	}
+	if err := snmp.Connect(); err != nil {
+		return nil, fmt.Errorf("Error connecting to target %s: %s", target, err)
+	}
+	return snmp, nil
+}
+
+// setTimeout sets the timeout of the next request of the session, capped at
+// what is left of ctx. It returns false if nothing is left.
+func setTimeout(ctx context.Context, snmp *gosnmp.GoSNMP, config *config.Module) bool {
+	if ctx.Err() != nil {
+		return false
+	}
+	// User specifies timeout of each retry attempt but GoSNMP expects total timeout for all attemtps.
+	snmp.Timeout = config.WalkParams.Timeout * time.Duration(config.WalkParams.Retries+1)
+	if deadline, ok := ctx.Deadline(); ok {
+		if left := time.Until(deadline); left < snmp.Timeout {
+			snmp.Timeout = left
 		}
-		log.Debugf("Walk of target %q subtree %q completed in %s", snmp.Target, subtree, time.Since(walkStart))
+	}
+	return true
+}
 
-		result = append(result, pdus...)
+// walkSubtrees walks subtrees, several of them in lockstep, and returns the
+// PDUs of each. If ctx ends it returns the PDUs so far with the error of ctx.
+func walkSubtrees(ctx context.Context, snmp *gosnmp.GoSNMP, config *config.Module, target string, subtrees []string) ([][]gosnmp.SnmpPDU, error) {
+	pdus := make([][]gosnmp.SnmpPDU, len(subtrees))
+	if !setTimeout(ctx, snmp, config) {
+		return pdus, ctx.Err()
+	}
+	log.Debugf("Walking target %q subtrees %q", snmp.Target, subtrees)
+	walkStart := time.Now()
+	walkFn := func(i int, pdu gosnmp.SnmpPDU) error {
+		pdus[i] = append(pdus[i], pdu)
+		if !setTimeout(ctx, snmp, config) {
+			return ctx.Err()
+		}
+		return nil
+	}
+	var err error
+	if snmp.Version == gosnmp.Version1 {
+		for i, subtree := range subtrees {
+			err = snmp.Walk(subtree, func(pdu gosnmp.SnmpPDU) error {
+				return walkFn(i, pdu)
+			})
+			if err != nil {
+				break
+			}
+		}
+	} else {
+		err = bulkWalk(ctx, snmp, config, target, subtrees, walkFn)
+	}
+	if err != nil {
+		if ctx.Err() != nil {
+			return pdus, ctx.Err()
+		}
+		return pdus, wrapError(err, "Error walking target %s", snmp.Target)
 	}
-	return result, nil
+	log.Debugf("Walk of target %q subtrees %q completed in %s", snmp.Target, subtrees, time.Since(walkStart))
+	return pdus, nil
 }
 
 type MetricNode struct {
@@ -162,8 +443,13 @@ func buildMetricTree(metrics []*config.Metric) *MetricNode {
 }
 
 type collector struct {
+	ctx    context.Context
 	target string
 	module *config.Module
+	// Scrapes in flight with the same key share their results, if set.
+	key string
+	// Constant labels added to every sample.
+	labels prometheus.Labels
 }
 
 // Describe implements Prometheus.Collector.
@@ -173,11 +459,34 @@ func (c collector) Describe(ch chan<- *prometheus.Desc) {
 
 // Collect implements Prometheus.Collector.
 func (c collector) Collect(ch chan<- prometheus.Metric) {
+	if len(c.labels) > 0 {
+		labeled, done := withLabels(ch, c.labels)
+		defer func() {
+			close(labeled)
+			<-done
+		}()
+		ch = labeled
+	}
 	start := time.Now()
-	pdus, err := ScrapeTarget(c.target, c.module)
+	results, err := c.scrape()
+	up := 1.0
+	if err != nil {
+		up = 0
+	}
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_up", "Whether the target could be scraped.", nil, nil),
+		prometheus.GaugeValue,
+		up)
 	if err != nil {
+		class := errorClass(err)
 		log.Infof("Error scraping target %s: %s", c.target, err)
-		ch <- prometheus.NewInvalidMetric(prometheus.NewDesc("snmp_error", "Error scraping target", nil, nil), err)
+		snmpScrapeErrors.WithLabelValues(class).Inc()
+		ch <- prometheus.MustNewConstMetric(
+			prometheus.NewDesc("snmp_scrape_error", "Class of the error the scrape failed with.", []string{"class"}, nil),
+			prometheus.GaugeValue,
+			1, class)
+		// Which subtrees were walked shows where the scrape failed.
+		collectSubtrees(ch, results.Subtrees)
 		return
 	}
 	ch <- prometheus.MustNewConstMetric(
@@ -187,9 +496,31 @@ func (c collector) Collect(ch chan<- prometheus.Metric) {
 	ch <- prometheus.MustNewConstMetric(
 		prometheus.NewDesc("snmp_scrape_pdus_returned", "PDUs returned from walk.", nil, nil),
 		prometheus.GaugeValue,
-		float64(len(pdus)))
-	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(pdus))
-	for _, pdu := range pdus {
+		float64(len(results.PDUs)))
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_pdus_cached", "PDUs returned from the cache of earlier scrapes rather than the target.", nil, nil),
+		prometheus.GaugeValue,
+		float64(results.CachedPDUs))
+	truncated := 0.0
+	if results.Truncated {
+		log.Infof("Scrape of target %s was truncated when it ran out of time", c.target)
+		truncated = 1
+	}
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_truncated", "Whether the scrape ran out of time before all OIDs were fetched.", nil, nil),
+		prometheus.GaugeValue,
+		truncated)
+	collectSubtrees(ch, results.Subtrees)
+	requestSize := int(c.module.WalkParams.MaxRepetitions)
+	if requestSize == 0 {
+		requestSize = defaultMaxRepetitions
+	}
+	ch <- prometheus.MustNewConstMetric(
+		prometheus.NewDesc("snmp_scrape_max_repetitions", "Largest max_repetitions and Get batch the target handles, at most the one of the module.", nil, nil),
+		prometheus.GaugeValue,
+		float64(targetRequestSizes.limit(c.target, requestSize)))
+	oidToPdu := make(map[string]gosnmp.SnmpPDU, len(results.PDUs))
+	for _, pdu := range results.PDUs {
 		oidToPdu[pdu.Name[1:]] = pdu
 	}
 
@@ -221,6 +552,84 @@ PduLoop:
 		float64(time.Since(start).Seconds()))
 }
 
+// collectSubtrees reports for each subtree whether it was walked in full, and
+// how long it took.
+func collectSubtrees(ch chan<- prometheus.Metric, subtrees []SubtreeResult) {
+	subtreeUp := prometheus.NewDesc("snmp_subtree_up", "Whether the subtree was walked completely.", []string{"subtree"}, nil)
+	subtreeDuration := prometheus.NewDesc("snmp_subtree_walk_duration_seconds", "Time walking the subtree took, shared by subtrees walked together.", []string{"subtree"}, nil)
+	seenSubtrees := map[string]bool{}
+	for _, subtree := range subtrees {
+		// Modules may list a subtree twice.
+		if seenSubtrees[subtree.Oid] {
+			continue
+		}
+		seenSubtrees[subtree.Oid] = true
+		walked := 0.0
+		if subtree.Walked {
+			walked = 1
+		}
+		ch <- prometheus.MustNewConstMetric(subtreeUp, prometheus.GaugeValue, walked, subtree.Oid)
+		ch <- prometheus.MustNewConstMetric(subtreeDuration, prometheus.GaugeValue, subtree.Duration.Seconds(), subtree.Oid)
+	}
+}
+
+// scrape scrapes the target once it has room for another walk, sharing the
+// walk of an identical scrape in flight.
+func (c collector) scrape() (ScrapeResults, error) {
+	scrape := func(ctx context.Context) (ScrapeResults, error) {
+		release, ok := targetWalks.acquire(ctx, c.target, *maxWalks)
+		if !ok {
+			return ScrapeResults{}, &scrapeError{
+				class: errorLimited,
+				msg:   fmt.Sprintf("Scrape of target %s ran out of time waiting for other walks of it to finish", c.target),
+			}
+		}
+		defer release()
+		return ScrapeTarget(ctx, c.target, c.module)
+	}
+	if c.key == "" {
+		return scrape(c.ctx)
+	}
+	return scrapes.do(c.ctx, c.key, scrape)
+}
+
+// withLabels returns a channel that adds the labels to every metric sent to
+// it before passing it on to ch. Once all metrics are sent it must be closed,
+// and the returned done channel waited on.
+func withLabels(ch chan<- prometheus.Metric, labels prometheus.Labels) (chan<- prometheus.Metric, <-chan struct{}) {
+	pairs := make([]*dto.LabelPair, 0, len(labels))
+	for name, value := range labels {
+		pairs = append(pairs, &dto.LabelPair{Name: proto.String(name), Value: proto.String(value)})
+	}
+	in := make(chan prometheus.Metric)
+	done := make(chan struct{})
+	go func() {
+		for m := range in {
+			ch <- labeledMetric{Metric: m, labels: pairs}
+		}
+		close(done)
+	}()
+	return in, done
+}
+
+// labeledMetric is a metric with additional constant labels.
+type labeledMetric struct {
+	prometheus.Metric
+	labels []*dto.LabelPair
+}
+
+// Write implements prometheus.Metric.
+func (m labeledMetric) Write(out *dto.Metric) error {
+	if err := m.Metric.Write(out); err != nil {
+		return err
+	}
+	out.Label = append(out.Label, m.labels...)
+	sort.Slice(out.Label, func(i, j int) bool {
+		return out.Label[i].GetName() < out.Label[j].GetName()
+	})
+	return nil
+}
+
 func getPduValue(pdu *gosnmp.SnmpPDU) float64 {
 	switch pdu.Type {
 	case gosnmp.Counter64:
@@ -362,7 +771,7 @@ func pduValueAsString(pdu *gosnmp.SnmpPDU, typ string) string {
 		return ""
 	default:
 		// This shouldn't happen.
-		log.Infof("Got PDU with unexpected type: Name: %s Value: '%s', Go Type: %T SNMP Type: %s", pdu.Name, pdu.Value, pdu.Value, pdu.Type)
+		log.Infof("Got PDU with unexpected type: Name: %s Value: '%s', Go Type: %T SNMP Type: %v", pdu.Name, pdu.Value, pdu.Value, pdu.Type)
 		snmpUnexpectedPduType.Inc()
 		return fmt.Sprintf("%s", pdu.Value)
 	}
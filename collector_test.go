@@ -14,10 +14,17 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
 	"reflect"
 	"regexp"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_model/go"
 	"github.com/soniah/gosnmp"
 
@@ -644,3 +651,663 @@ func TestIndexesToLabels(t *testing.T) {
 		}
 	}
 }
+
+func TestWithLabels(t *testing.T) {
+	out := make(chan prometheus.Metric, 1)
+	ch, done := withLabels(out, prometheus.Labels{"org": "1", "sys": "2"})
+	ch <- prometheus.MustNewConstMetric(prometheus.NewDesc("test_metric", "Help string", []string{"zone"}, nil),
+		prometheus.GaugeValue, 3, "a")
+	close(ch)
+	<-done
+
+	metric := &io_prometheus_client.Metric{}
+	if err := (<-out).Write(metric); err != nil {
+		t.Fatalf("Error writing metric: %v", err)
+	}
+	want := `label:<name:"org" value:"1" > label:<name:"sys" value:"2" > label:<name:"zone" value:"a" > gauge:<value:3 > `
+	if metric.String() != want {
+		t.Errorf("Unexpected metric: got %v, want %v", metric.String(), want)
+	}
+}
+
+func TestScrapeTargetTruncated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	module := &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2"},
+		WalkParams: config.DefaultWalkParams,
+	}
+	results, err := ScrapeTarget(ctx, "127.0.0.1:1", module)
+	if err == nil || errorClass(err) != errorTimeout {
+		t.Fatalf("Expected a timeout, got %v", err)
+	}
+	if results.Truncated || len(results.PDUs) != 0 {
+		t.Errorf("Expected an empty scrape, got %+v", results)
+	}
+	if len(results.Subtrees) != 1 || results.Subtrees[0].Walked {
+		t.Errorf("Expected the subtree not to be walked, got %+v", results.Subtrees)
+	}
+}
+
+func TestScrapeTargetNoResponse(t *testing.T) {
+	// A target that never responds.
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %v", err)
+	}
+	defer conn.Close()
+
+	modules := map[string]*config.Module{
+		"get":  {Get: []string{"1.3.6.1.2.1.1.1.0"}, WalkParams: config.DefaultWalkParams},
+		"walk": {Walk: []string{"1.3.6.1.2.1.2"}, WalkParams: config.DefaultWalkParams},
+	}
+	for name, module := range modules {
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		results, err := ScrapeTarget(ctx, conn.LocalAddr().String(), module)
+		cancel()
+		if err == nil || errorClass(err) != errorTimeout {
+			t.Errorf("%s: Expected a timeout, got %v", name, err)
+		}
+		if results.Truncated {
+			t.Errorf("%s: Expected the scrape not to be truncated", name)
+		}
+	}
+}
+
+func TestCollectFailedSubtrees(t *testing.T) {
+	module := &config.Module{
+		Walk:       []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31"},
+		WalkParams: config.DefaultWalkParams,
+	}
+	registry := prometheus.NewRegistry()
+	// The port is invalid, so the scrape fails before walking anything.
+	registry.MustRegister(newCollector(context.Background(), "127.0.0.1:snmp", "if_mib", module, 0, 0))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %v", err)
+	}
+	got := map[string]int{}
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			if family.GetName() == "snmp_up" && metric.GetGauge().GetValue() != 0 {
+				t.Errorf("Expected the scrape to fail, got snmp_up %v", metric.GetGauge().GetValue())
+			}
+			if family.GetName() == "snmp_subtree_up" && metric.GetGauge().GetValue() != 0 {
+				t.Errorf("Expected no subtree to be walked, got %v", metric)
+			}
+			got[family.GetName()]++
+		}
+	}
+	if got["snmp_scrape_error"] != 1 || got["snmp_subtree_up"] != 2 || got["snmp_subtree_walk_duration_seconds"] != 2 {
+		t.Errorf("Expected the error and both subtrees to be reported, got %v", got)
+	}
+}
+
+func TestScrapeContext(t *testing.T) {
+	r := httptest.NewRequest("GET", "/snmp?target=1.2.3.4", nil)
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "2.5")
+	ctx, cancel, err := scrapeContext(r)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > 2500*time.Millisecond {
+		t.Errorf("Expected a deadline within the scrape timeout, got %v", deadline)
+	}
+
+	r.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", "soon")
+	if _, _, err := scrapeContext(r); err == nil {
+		t.Error("Expected error for invalid scrape timeout")
+	}
+}
+
+func TestSessionCounter(t *testing.T) {
+	c := newSessionCounter()
+	c.add("a")
+	if !c.tryAdd("a", 2) {
+		t.Fatal("Expected room for a second session")
+	}
+	if c.tryAdd("a", 2) {
+		t.Fatal("Expected no room for a third session")
+	}
+	if !c.tryAdd("b", 2) || !c.tryAdd("a", 0) {
+		t.Fatal("Expected room on another target, and without a limit")
+	}
+	c.done("a")
+	c.done("a")
+	c.done("a")
+	c.done("b")
+	if len(c.open) != 0 {
+		t.Errorf("Expected no sessions left, got %v", c.open)
+	}
+}
+
+func TestEngineCache(t *testing.T) {
+	c := newEngineCache()
+	wp := config.DefaultWalkParams
+	wp.Version = 3
+	wp.Auth.Username = "user"
+	session := func() *gosnmp.GoSNMP {
+		snmp := &gosnmp.GoSNMP{}
+		wp.ConfigureSNMP(snmp)
+		return snmp
+	}
+
+	snmp := session()
+	if c.restore("a", wp, snmp, time.Minute) {
+		t.Fatal("Expected nothing cached")
+	}
+	params := snmp.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	params.AuthoritativeEngineID = "engine"
+	params.AuthoritativeEngineBoots = 1
+	params.AuthoritativeEngineTime = 100
+	snmp.ContextEngineID = "engine"
+	c.update("a", wp, snmp, false, time.Minute)
+
+	snmp = session()
+	if !c.restore("a", wp, snmp, time.Minute) {
+		t.Fatal("Expected the engine to be cached")
+	}
+	restored := snmp.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if restored.AuthoritativeEngineID != "engine" || restored.AuthoritativeEngineTime < 100 || snmp.ContextEngineID != "engine" {
+		t.Errorf("Unexpected restored engine: %+v, context engine %q", restored, snmp.ContextEngineID)
+	}
+	other := wp
+	other.Auth.Username = "other"
+	if c.restore("a", other, session(), time.Minute) || c.restore("b", wp, session(), time.Minute) {
+		t.Error("Expected the engine to be cached for the target and user only")
+	}
+
+	// The target rebooted, as a notInTimeWindow report would tell.
+	restored.AuthoritativeEngineBoots = 2
+	c.update("a", wp, snmp, false, time.Minute)
+	if c.restore("a", wp, session(), time.Minute) {
+		t.Error("Expected the engine to be invalidated")
+	}
+
+	c.update("a", wp, snmp, false, time.Minute)
+	c.update("a", wp, session(), true, time.Minute)
+	if c.restore("a", wp, session(), time.Minute) {
+		t.Error("Expected the engine to be invalidated by a failed scrape")
+	}
+
+	c.update("a", wp, snmp, false, time.Minute)
+	if c.restore("a", wp, session(), time.Nanosecond) {
+		t.Error("Expected the engine to expire")
+	}
+}
+
+func TestPDUCache(t *testing.T) {
+	c := newPDUCache()
+	wp := config.DefaultWalkParams
+	pdus := []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.2.2.1.2.1", Type: gosnmp.OctetString, Value: []byte("eth0")}}
+
+	c.put("a", wp, "1.3.6.1.2.1.2.2.1.2", pdus, 0)
+	if _, ok := c.get("a", wp, "1.3.6.1.2.1.2.2.1.2", time.Hour); ok {
+		t.Fatal("Expected nothing cached without a TTL")
+	}
+	c.put("a", wp, "1.3.6.1.2.1.2.2.1.2", pdus, time.Hour)
+	if cached, ok := c.get("a", wp, "1.3.6.1.2.1.2.2.1.2", time.Hour); !ok || !reflect.DeepEqual(cached, pdus) {
+		t.Errorf("Expected the PDUs to be cached, got %v", cached)
+	}
+	other := wp
+	other.Auth.ContextName = "vlan-2"
+	if _, ok := c.get("a", other, "1.3.6.1.2.1.2.2.1.2", time.Hour); ok {
+		t.Error("Expected the PDUs to be cached for the context only")
+	}
+	if _, ok := c.get("b", wp, "1.3.6.1.2.1.2.2.1.2", time.Hour); ok {
+		t.Error("Expected the PDUs to be cached for the target only")
+	}
+
+	c.put("a", wp, "1.3.6.1.2.1.1.1.0", nil, time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	if _, ok := c.get("a", wp, "1.3.6.1.2.1.1.1.0", time.Hour); ok {
+		t.Error("Expected the PDUs to expire")
+	}
+}
+
+func TestScrapeTargetCached(t *testing.T) {
+	module := &config.Module{
+		Walk: []string{"1.3.6.1.2.1.2.2.1.2"},
+		Get:  []string{"1.3.6.1.2.1.1.1.0"},
+		Metrics: []*config.Metric{
+			{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", CacheTTL: time.Hour},
+			{Name: "sysDescr", Oid: "1.3.6.1.2.1.1.1", CacheTTL: time.Hour},
+		},
+		WalkParams: config.DefaultWalkParams,
+	}
+	target := "127.0.0.1:1"
+	targetPDUs.put(target, module.WalkParams, "1.3.6.1.2.1.2.2.1.2", []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.2.2.1.2.1"}}, time.Hour)
+	targetPDUs.put(target, module.WalkParams, "1.3.6.1.2.1.1.1.0", []gosnmp.SnmpPDU{{Name: ".1.3.6.1.2.1.1.1.0"}}, time.Hour)
+
+	// The target is not contacted, so the scrape is not cut short.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	results, err := ScrapeTarget(ctx, target, module)
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if results.Truncated || len(results.PDUs) != 2 || results.CachedPDUs != 2 || !results.Subtrees[0].Walked {
+		t.Errorf("Expected the results from the cache, got %+v", results)
+	}
+}
+
+// testTargets is a config.TargetSource for tests.
+type testTargets struct {
+	targets []config.PollTarget
+}
+
+func (s *testTargets) LoadTargets() ([]config.PollTarget, error) {
+	return s.targets, nil
+}
+
+func (s *testTargets) String() string {
+	return "test targets"
+}
+
+func TestPoller(t *testing.T) {
+	source := &testTargets{targets: []config.PollTarget{{Target: "1.2.3.4", Module: "if_mib"}}}
+	// Without workers and with a long interval nothing is polled.
+	targetPoller = newPoller(source, 0, time.Hour)
+	defer func() { targetPoller = nil }()
+	if err := targetPoller.reload(); err != nil {
+		t.Fatalf("Error loading targets: %v", err)
+	}
+	polled := targetPoller.lookup(scrapeKey("1.2.3.4", "if_mib", 0, 0))
+	if polled == nil {
+		t.Fatal("Expected the target to be polled")
+	}
+
+	scrape := func() string {
+		w := httptest.NewRecorder()
+		handler(w, httptest.NewRequest("GET", "/snmp?target=1.2.3.4&module=if_mib", nil))
+		return w.Body.String()
+	}
+	if body := scrape(); !strings.Contains(body, "snmp_up 0") || strings.Contains(body, "snmp_poll_age_seconds") {
+		t.Errorf("Expected the target to be down before its first poll, got %q", body)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(prometheus.NewGauge(prometheus.GaugeOpts{Name: "ifNumber", Help: "ifNumber"}))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	polled.families, polled.polled = families, time.Now()
+	if body := scrape(); !strings.Contains(body, "ifNumber 0") || !strings.Contains(body, "snmp_poll_age_seconds") {
+		t.Errorf("Expected the results of the poll, got %q", body)
+	}
+	maxAge := *pollMaxAge
+	*pollMaxAge = time.Minute
+	defer func() { *pollMaxAge = maxAge }()
+	polled.polled = time.Now().Add(-2 * time.Minute)
+	if body := scrape(); !strings.Contains(body, "snmp_up 0") || strings.Contains(body, "ifNumber") {
+		t.Errorf("Expected stale results not to be served, got %q", body)
+	}
+
+	// A new interval restarts the polls, keeping the results.
+	source.targets[0].Interval = 2 * time.Hour
+	if err := targetPoller.reload(); err != nil {
+		t.Fatalf("Error reloading targets: %v", err)
+	}
+	if restarted := targetPoller.lookup(polled.key); restarted == polled || len(restarted.families) != 1 {
+		t.Error("Expected the target to be restarted with its results")
+	}
+	source.targets = nil
+	if err := targetPoller.reload(); err != nil {
+		t.Fatalf("Error reloading targets: %v", err)
+	}
+	if targetPoller.lookup(polled.key) != nil {
+		t.Error("Expected the target to no longer be polled")
+	}
+}
+
+func TestPollOffset(t *testing.T) {
+	for _, interval := range []time.Duration{time.Second, time.Hour, 24 * time.Hour} {
+		var max time.Duration
+		for i := 0; i < 1000; i++ {
+			offset := pollOffset(scrapeKey(fmt.Sprintf("10.0.%d.%d", i/256, i%256), "if_mib", 0, 0), interval)
+			if offset < 0 || offset >= interval {
+				t.Fatalf("Expected an offset within the interval %v, got %v", interval, offset)
+			}
+			if offset > max {
+				max = offset
+			}
+		}
+		if max < interval*9/10 {
+			t.Errorf("Expected the offsets to cover the interval %v, got at most %v", interval, max)
+		}
+	}
+}
+
+func TestScrapeGroup(t *testing.T) {
+	g := newScrapeGroup()
+	release := make(chan struct{})
+	calls := 0
+	scrape := func(ctx context.Context) (ScrapeResults, error) {
+		calls++
+		<-release
+		return ScrapeResults{PDUs: []gosnmp.SnmpPDU{{Name: ".1.2.3"}}}, nil
+	}
+
+	results := make(chan ScrapeResults)
+	for i := 0; i < 2; i++ {
+		go func() {
+			r, _ := g.do(context.Background(), "a", scrape)
+			results <- r
+		}()
+	}
+	// Wait until both scrapes are in flight.
+	for {
+		g.mtx.Lock()
+		f := g.flights["a"]
+		waiters := 0
+		if f != nil {
+			waiters = f.waiters
+		}
+		g.mtx.Unlock()
+		if waiters == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for i := 0; i < 2; i++ {
+		if r := <-results; len(r.PDUs) != 1 {
+			t.Errorf("Unexpected results: %+v", r)
+		}
+	}
+	if calls != 1 {
+		t.Errorf("Expected one scrape, got %d", calls)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	r, err := g.do(ctx, "b", func(ctx context.Context) (ScrapeResults, error) {
+		<-ctx.Done()
+		return ScrapeResults{Truncated: true}, nil
+	})
+	if err != nil || !r.Truncated {
+		t.Errorf("Expected truncated results once the scrape is abandoned, got %+v, %v", r, err)
+	}
+}
+
+func TestScrapeGroupDeadline(t *testing.T) {
+	g := newScrapeGroup()
+	started := make(chan struct{})
+	// Fetches one PDU, and runs out of time before the next.
+	scrape := func(ctx context.Context) (ScrapeResults, error) {
+		close(started)
+		<-ctx.Done()
+		return ScrapeResults{PDUs: []gosnmp.SnmpPDU{{Name: ".1.2.3"}}, Truncated: true}, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	type result struct {
+		results ScrapeResults
+		err     error
+	}
+	first := make(chan result)
+	go func() {
+		r, err := g.do(ctx, "a", scrape)
+		first <- result{r, err}
+	}()
+	<-started
+	// Scrapes with the same deadline share what was fetched so far, ones
+	// that run out of time earlier get nothing.
+	r, err := g.do(ctx, "a", nil)
+	if err != nil || !r.Truncated || len(r.PDUs) != 1 {
+		t.Errorf("Expected the partial results of the scrape in flight, got %+v, %v", r, err)
+	}
+	if r := <-first; r.err != nil || !r.results.Truncated || len(r.results.PDUs) != 1 {
+		t.Errorf("Expected the partial results of the scrape, got %+v, %v", r.results, r.err)
+	}
+
+	long, cancelLong := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelLong()
+	started = make(chan struct{})
+	go g.do(long, "b", func(ctx context.Context) (ScrapeResults, error) {
+		close(started)
+		<-ctx.Done()
+		return ScrapeResults{Truncated: true}, nil
+	})
+	<-started
+	short, cancelShort := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancelShort()
+	if _, err := g.do(short, "b", nil); err == nil || errorClass(err) != errorTimeout {
+		t.Errorf("Expected a timeout waiting for a longer scrape, got %v", err)
+	}
+}
+
+func TestWalkLimiter(t *testing.T) {
+	l := newWalkLimiter()
+	release, ok := l.acquire(context.Background(), "a", 1)
+	if !ok {
+		t.Fatal("Expected a free slot")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, ok := l.acquire(ctx, "a", 1); ok {
+		t.Fatal("Expected no slot while another walk holds it")
+	}
+	if other, ok := l.acquire(ctx, "b", 1); !ok {
+		t.Fatal("Expected a slot on another target")
+	} else {
+		other()
+	}
+	release()
+	release, ok = l.acquire(context.Background(), "a", 1)
+	if !ok {
+		t.Fatal("Expected the slot to be free again")
+	}
+	release()
+	if len(l.targets) != 0 {
+		t.Errorf("Expected no targets left, got %v", l.targets)
+	}
+}
+
+func TestCollectWalkLimited(t *testing.T) {
+	max := *maxWalks
+	*maxWalks = 1
+	defer func() { *maxWalks = max }()
+	release, ok := targetWalks.acquire(context.Background(), "127.0.0.1:1", 1)
+	if !ok {
+		t.Fatal("Expected a free slot")
+	}
+	defer release()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	module := &config.Module{Walk: []string{"1.3.6.1.2.1.2"}, WalkParams: config.DefaultWalkParams}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCollector(ctx, "127.0.0.1:1", "if_mib", module, 0, 0))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatalf("Error gathering metrics: %v", err)
+	}
+	seen := 0
+	for _, family := range families {
+		metric := family.Metric[0]
+		switch family.GetName() {
+		case "snmp_up":
+			if metric.GetGauge().GetValue() != 0 {
+				t.Error("Expected a scrape that never walked the target to be down")
+			}
+			seen++
+		case "snmp_scrape_error":
+			if class := metric.Label[0].GetValue(); class != errorLimited {
+				t.Errorf("Expected the scrape to fail with class %s, got %s", errorLimited, class)
+			}
+			seen++
+		}
+	}
+	if seen != 2 {
+		t.Errorf("Expected snmp_up and snmp_scrape_error to be reported, saw %d of them", seen)
+	}
+}
+
+func TestRequestSizes(t *testing.T) {
+	s := newRequestSizes(time.Hour)
+	if got := s.limit("a", 25); got != 25 {
+		t.Errorf("Expected the module's size before any failure, got %d", got)
+	}
+	if got := s.shrink("a", 25); got != 12 {
+		t.Errorf("Expected the size to be halved, got %d", got)
+	}
+	if got := s.limit("a", 25); got != 12 {
+		t.Errorf("Expected the size that worked to be remembered, got %d", got)
+	}
+	if got := s.limit("a", 5); got != 5 {
+		t.Errorf("Expected a smaller size of the module to be kept, got %d", got)
+	}
+	if got := s.limit("b", 25); got != 25 {
+		t.Errorf("Expected other targets to be unaffected, got %d", got)
+	}
+	if got := s.shrink("a", 1); got != 1 {
+		t.Errorf("Expected the size to stay at least 1, got %d", got)
+	}
+
+	s = newRequestSizes(0)
+	s.shrink("a", 25)
+	if got := s.limit("a", 25); got != 25 {
+		t.Errorf("Expected the size to be forgotten, got %d", got)
+	}
+}
+
+func TestTooLarge(t *testing.T) {
+	ctx := context.Background()
+	tooBig := &gosnmp.SnmpPacket{Error: gosnmp.TooBig}
+	timeout := fmt.Errorf("Request timeout (after 3 retries)")
+	for _, c := range []struct {
+		packet    *gosnmp.SnmpPacket
+		err       error
+		size      int
+		responded bool
+		want      bool
+	}{
+		{packet: tooBig, size: 10, want: true},
+		{packet: tooBig, size: 1, want: false},
+		{packet: &gosnmp.SnmpPacket{Error: gosnmp.GenErr}, size: 10, want: false},
+		{err: timeout, size: 10, responded: true, want: true},
+		{err: timeout, size: 10, responded: false, want: false},
+		{err: fmt.Errorf("connection refused"), size: 10, responded: true, want: false},
+	} {
+		if got := tooLarge(ctx, c.packet, c.err, c.size, c.responded); got != c.want {
+			t.Errorf("tooLarge(%+v, %v, %d, %t) = %t, want %t", c.packet, c.err, c.size, c.responded, got, c.want)
+		}
+	}
+}
+
+func TestWalkGroups(t *testing.T) {
+	subtrees := []string{
+		"1.3.6.1.2.1.2.2.1.2",
+		"1.3.6.1.2.1.1",
+		"1.3.6.1.2.1.2.2.1.10",
+		"1.3.6.1.2.1.2.2.1.16",
+		"1.3.6.1.2.1.31.1.1.1.6",
+	}
+	got := walkGroups(subtrees, 2)
+	want := [][]int{{0, 2}, {1}, {3}, {4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected groups: got %v, want %v", got, want)
+	}
+	got = walkGroups(subtrees, 1)
+	want = [][]int{{0}, {1}, {2}, {3}, {4}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Unexpected groups of one: got %v, want %v", got, want)
+	}
+}
+
+func TestSplitBulk(t *testing.T) {
+	roots := []string{".1.1", ".1.2", ".1.3", ".1.4"}
+	// The last subtree was walked by earlier requests.
+	next := []string{".1.1", ".1.2", ".1.3", ".1.4.5"}
+	pdu := func(name string) gosnmp.SnmpPDU {
+		return gosnmp.SnmpPDU{Name: name, Type: gosnmp.Integer, Value: 1}
+	}
+	variables := []gosnmp.SnmpPDU{
+		pdu(".1.1.1"), pdu(".1.2.1"), pdu(".1.9"), pdu(".1.5"),
+		pdu(".1.1.2"), {Name: ".1.2.1", Type: gosnmp.EndOfMibView}, pdu(".1.9.1"), pdu(".1.5.1"),
+	}
+	walked := map[int][]string{}
+	finished, leaves, err := splitBulk(variables, []int{0, 1, 2, 3}, roots, next, func(i int, pdu gosnmp.SnmpPDU) error {
+		walked[i] = append(walked[i], pdu.Name)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Error splitting response: %v", err)
+	}
+	if want := map[int][]string{0: {".1.1.1", ".1.1.2"}, 1: {".1.2.1"}}; !reflect.DeepEqual(walked, want) {
+		t.Errorf("Expected varbinds %v, got %v", want, walked)
+	}
+	if want := map[int]bool{1: true, 2: true, 3: true}; !reflect.DeepEqual(finished, want) {
+		t.Errorf("Expected finished subtrees %v, got %v", want, finished)
+	}
+	// Only a subtree whose first varbind is outside of it is a single OID.
+	if want := []int{2}; !reflect.DeepEqual(leaves, want) {
+		t.Errorf("Expected subtrees to get %v, got %v", want, leaves)
+	}
+	if next[0] != ".1.1.2" || next[1] != ".1.2.1" {
+		t.Errorf("Next OIDs not advanced: %v", next)
+	}
+
+	_, _, err = splitBulk([]gosnmp.SnmpPDU{pdu(".1.1.2")}, []int{0}, roots, next, func(int, gosnmp.SnmpPDU) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "not increasing") {
+		t.Errorf("Expected error for an OID that is not increasing, got %v", err)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	for _, c := range []struct {
+		err   error
+		class string
+		msg   string
+	}{
+		{
+			err:   wrapError(fmt.Errorf("Request timeout (after 3 retries)"), "Error getting target %s", "a"),
+			class: errorTimeout,
+			msg:   "Error getting target a: Request timeout (after 3 retries)",
+		},
+		{
+			err:   wrapError(fmt.Errorf("Unable to decode packet: Incoming packet is not authentic, discarding"), "Error walking target %s", "a"),
+			class: errorAuth,
+		},
+		{
+			err:   wrapError(fmt.Errorf("Unable to decode packet: nil"), "Error walking target %s", "a"),
+			class: errorDecode,
+		},
+		{
+			err:   wrapError(statusError("a", gosnmp.GenErr), "Error walking target %s", "a"),
+			class: errorGenErr,
+			msg:   "Error walking target a: Error reported by target a: genErr",
+		},
+		{
+			err:   statusError("a", gosnmp.TooBig),
+			class: errorTooBig,
+		},
+		{
+			err:   statusError("a", 42),
+			class: errorOther,
+			msg:   "Error reported by target a: error status 42",
+		},
+		{
+			err: reportError("a", &gosnmp.SnmpPacket{
+				Variables: []gosnmp.SnmpPDU{{Name: ".1.3.6.1.6.3.15.1.1.3.0"}},
+			}),
+			class: errorAuth,
+			msg:   "Error reported by target a: unknownUserName",
+		},
+		{
+			err:   fmt.Errorf("Error connecting to target a: no such host"),
+			class: errorOther,
+		},
+	} {
+		if got := errorClass(c.err); got != c.class {
+			t.Errorf("Unexpected class of %q: got %s, want %s", c.err, got, c.class)
+		}
+		if c.msg != "" && c.err.Error() != c.msg {
+			t.Errorf("Unexpected message: got %q, want %q", c.err, c.msg)
+		}
+	}
+}
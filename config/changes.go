@@ -0,0 +1,59 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"reflect"
+	"sort"
+)
+
+// Changes lists the names of the modules that differ between two configs.
+type Changes struct {
+	Added    []string
+	Removed  []string
+	Modified []string
+}
+
+// Empty returns whether no module changed.
+func (c Changes) Empty() bool {
+	return len(c.Added) == 0 && len(c.Removed) == 0 && len(c.Modified) == 0
+}
+
+// Update returns the modules of newConfig, reusing those of oldConfig that
+// did not change, along with what changed.
+func Update(oldConfig, newConfig Config) (Config, Changes) {
+	changes := Changes{}
+	updated := make(Config, len(newConfig))
+	for name, module := range newConfig {
+		old, ok := oldConfig[name]
+		switch {
+		case !ok:
+			changes.Added = append(changes.Added, name)
+		case !reflect.DeepEqual(old, module):
+			changes.Modified = append(changes.Modified, name)
+		default:
+			module = old
+		}
+		updated[name] = module
+	}
+	for name := range oldConfig {
+		if _, ok := newConfig[name]; !ok {
+			changes.Removed = append(changes.Removed, name)
+		}
+	}
+	sort.Strings(changes.Added)
+	sort.Strings(changes.Removed)
+	sort.Strings(changes.Modified)
+	return updated, changes
+}
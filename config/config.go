@@ -15,97 +15,74 @@ package config
 
 import (
 	"fmt"
-	// "io/ioutil"
+	"io/ioutil"
+	"os"
 	"regexp"
+	"strings"
 	"time"
 
 	"github.com/soniah/gosnmp"
-	// "gopkg.in/yaml.v2"
-	"database/sql"
-	 _ "github.com/go-sql-driver/mysql"
-	 "github.com/prometheus/common/log"
+	"gopkg.in/yaml.v2"
 )
 
+// LoadFile reads a configuration file, and resolves the modules that extend
+// others.
 func LoadFile(filename string) (*Config, error) {
-	// content, err := ioutil.ReadFile(filename)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// cfg := &Config{}
-	// err = yaml.UnmarshalStrict(content, cfg)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// return cfg, nil
-
-
-	cfg := Config{}
-
-	db, err := sql.Open("mysql", "CloudInsight:Cloud@tcp(192.168.1.204:3306)/CloudwizHardwareInfo?charset=utf8")
-
-	if (err != nil) {
-		log.Errorln(err)
-	}
-	moduleRows, err := db.Query("SELECT * FROM cw_hardware_module")
-	if (err != nil) {
-		log.Errorln(err)
-	}
-
-	for moduleRows.Next() {
-		var id int
-		var categoryId int
-		var module string
-		var name string
-		var remark string
-		var icon string
-
-		_ = moduleRows.Scan(&id, &categoryId, &module, &name, &remark, &icon)
-
-		metricsRows, _ := db.Query("SELECT id,name,oid,type as metric_type,help,request_type,module,org_id,sys_id FROM cw_snmp_custom_metrics WHERE module = '" + module + "'")
-
-		var walkArr []string
-		var getArr []string
-		var metricsArr []*Metric
-		for metricsRows.Next() {
-			var id int
-			var name string
-			var oid string
-			var metricType string
-			var help string
-			var requestType string
-			var module string
-			var orgId int
-			var sysId int
-
-			metricsRows.Scan(&id, &name, &oid, &metricType, &help, &requestType, &module, &orgId, &sysId)
-			if requestType == "walk" {
-				walkArr = append(walkArr, oid)
-			} else if requestType == "get" {
-				getArr = append(getArr, oid)
-			}
+	cfg, err := ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.Resolve(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
 
-			metrics := &Metric{
-				Name: name,
-				Oid: oid,
-				Type: metricType,
-				Help: help,
-			}
-			metricsArr = append(metricsArr, metrics)
-		}
-		moduleCon := &Module{
-			Walk: walkArr,
-			Get: getArr,
-			Metrics: metricsArr,
-			WalkParams: DefaultWalkParams,
-		}
-		// fmt.Println(*module)
-		cfg[module] = moduleCon
+// ReadFile reads a configuration file as written, without resolving the
+// modules that extend others. The secrets are read from their files and
+// environment variables.
+func ReadFile(filename string) (*Config, error) {
+	cfg, err := ReadRawFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
 	}
+	return cfg, nil
+}
 
-	defer db.Close()
+// ReadRawFile reads a configuration file as written, keeping the references
+// to secrets in files and environment variables rather than reading them.
+func ReadRawFile(filename string) (*Config, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshal(content)
+}
 
-	return &cfg, nil
+func parse(content []byte) (*Config, error) {
+	cfg, err := unmarshal(content)
+	if err != nil {
+		return nil, err
+	}
+	if err := cfg.resolveSecrets(); err != nil {
+		return nil, err
+	}
+	if err := cfg.Resolve(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+func unmarshal(content []byte) (*Config, error) {
+	cfg := &Config{}
+	err := yaml.UnmarshalStrict(content, cfg)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
 }
 
 var (
@@ -139,14 +116,98 @@ type WalkParams struct {
 	Retries        int           `yaml:"retries,omitempty"`
 	Timeout        time.Duration `yaml:"timeout,omitempty"`
 	Auth           Auth          `yaml:"auth,omitempty"`
+	// How many subtrees to walk in parallel, each over its own session.
+	WalkConcurrency int `yaml:"walk_concurrency,omitempty"`
+	// Whether to go on with the other subtrees when walking one fails.
+	PartialResults bool `yaml:"partial_results,omitempty"`
 }
 
 type Module struct {
+	// Modules this one builds upon, see Config.Resolve.
+	Extends []string `yaml:"extends,omitempty"`
 	// A list of OIDs.
 	Walk       []string   `yaml:"walk,omitempty"`
 	Get        []string   `yaml:"get,omitempty"`
 	Metrics    []*Metric  `yaml:"metrics"`
 	WalkParams WalkParams `yaml:",inline"`
+
+	// The walk parameters set for the module, by their YAML names with
+	// those of auth prefixed by "auth.". Modules extending others only
+	// override these.
+	setParams map[string]bool
+}
+
+// walkLookups adds the OIDs that lookups read from to the walk, unless they
+// are already walked or fetched.
+func (c *Module) walkLookups() {
+	for _, metric := range c.Metrics {
+		for _, lookup := range metric.Lookups {
+			if !c.covers(lookup.Oid) {
+				c.Walk = append(c.Walk, lookup.Oid)
+			}
+		}
+	}
+}
+
+// covers returns whether oid is within one of the walked subtrees, or is
+// one of the OIDs to get.
+func (c *Module) covers(oid string) bool {
+	for _, subtree := range c.Walk {
+		if oidWithin(oid, subtree) {
+			return true
+		}
+	}
+	for _, get := range c.Get {
+		if oid == get {
+			return true
+		}
+	}
+	return false
+}
+
+// getsWithin returns whether one of the OIDs to get is oid or below it, as
+// the instance of a scalar is.
+func (c *Module) getsWithin(oid string) bool {
+	for _, get := range c.Get {
+		if oidWithin(get, oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// CacheTTL returns how long the PDUs of a walked subtree or an OID to get
+// may be reused across scrapes. That is the shortest cache_ttl of the metrics
+// and lookups reading from it, and none if any of them has no cache_ttl.
+func (c *Module) CacheTTL(oid string) time.Duration {
+	type reader struct {
+		oid string
+		ttl time.Duration
+	}
+	var ttl time.Duration
+	for _, metric := range c.Metrics {
+		readers := []reader{{metric.Oid, metric.CacheTTL}}
+		for _, lookup := range metric.Lookups {
+			readers = append(readers, reader{lookup.Oid, lookup.CacheTTL})
+		}
+		for _, r := range readers {
+			if !oidWithin(r.oid, oid) && !oidWithin(oid, r.oid) {
+				continue
+			}
+			if r.ttl <= 0 {
+				return 0
+			}
+			if ttl == 0 || r.ttl < ttl {
+				ttl = r.ttl
+			}
+		}
+	}
+	return ttl
+}
+
+// oidWithin returns whether oid is subtree or below it.
+func oidWithin(oid, subtree string) bool {
+	return oid == subtree || strings.HasPrefix(oid, subtree+".")
 }
 
 func (c *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
@@ -155,32 +216,60 @@ func (c *Module) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal((*plain)(c)); err != nil {
 		return err
 	}
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	c.setParams = givenParams(raw)
+	return nil
+}
 
-	wp := c.WalkParams
+// resolveSecrets reads the secrets of the modules, and checks the walk
+// parameters of those that do not extend others. Modules that extend others
+// are checked once resolved.
+func (c Config) resolveSecrets() error {
+	for name, m := range c {
+		if err := m.WalkParams.Auth.resolveSecrets(); err != nil {
+			return fmt.Errorf("Module %s: %s", name, err)
+		}
+		if len(m.Extends) > 0 {
+			continue
+		}
+		if err := m.WalkParams.Validate(); err != nil {
+			return fmt.Errorf("Module %s: %s", name, err)
+		}
+	}
+	return nil
+}
 
-	if wp.Version < 1 || wp.Version > 3 {
-		return fmt.Errorf("SNMP version must be 1, 2 or 3. Got: %d", wp.Version)
+// Validate checks that the SNMP version and auth settings are usable.
+func (c WalkParams) Validate() error {
+	if c.Version < 1 || c.Version > 3 {
+		return fmt.Errorf("SNMP version must be 1, 2 or 3. Got: %d", c.Version)
 	}
-	if wp.Version == 3 {
-		switch wp.Auth.SecurityLevel {
+	if c.WalkConcurrency < 0 {
+		return fmt.Errorf("Walk concurrency must not be negative. Got: %d", c.WalkConcurrency)
+	}
+	if c.Version == 3 {
+		switch c.Auth.SecurityLevel {
 		case "authPriv":
-			if wp.Auth.PrivPassword == "" {
+			if c.Auth.PrivPassword == "" {
 				return fmt.Errorf("Priv password is missing, required for SNMPv3 with priv.")
 			}
-			if wp.Auth.PrivProtocol != "DES" && wp.Auth.PrivProtocol != "AES" {
+			if c.Auth.PrivProtocol != "DES" && c.Auth.PrivProtocol != "AES" {
 				return fmt.Errorf("Priv protocol must be DES or AES.")
 			}
 			fallthrough
 		case "authNoPriv":
-			if wp.Auth.Password == "" {
+			if c.Auth.Password == "" {
 				return fmt.Errorf("Auth password is missing, required for SNMPv3 with auth.")
 			}
-			if wp.Auth.AuthProtocol != "MD5" && wp.Auth.AuthProtocol != "SHA" {
+			if c.Auth.AuthProtocol != "MD5" && c.Auth.AuthProtocol != "SHA" {
 				return fmt.Errorf("Auth protocol must be SHA or MD5.")
 			}
 			fallthrough
 		case "noAuthNoPriv":
-			if wp.Auth.Username == "" {
+			if c.Auth.Username == "" {
 				return fmt.Errorf("Auth username is missing, required for SNMPv3")
 			}
 		default:
@@ -249,6 +338,10 @@ type Metric struct {
 	Indexes        []*Index                   `yaml:"indexes,omitempty"`
 	Lookups        []*Lookup                  `yaml:"lookups,omitempty"`
 	RegexpExtracts map[string][]RegexpExtract `yaml:"regex_extracts,omitempty"`
+	OrgID          int                        `yaml:"org_id,omitempty"`
+	SysID          int                        `yaml:"sys_id,omitempty"`
+	// How long the PDUs of the metric may be reused across scrapes.
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"`
 }
 
 type Index struct {
@@ -262,6 +355,8 @@ type Lookup struct {
 	Labelname string   `yaml:"labelname"`
 	Oid       string   `yaml:"oid"`
 	Type      string   `yaml:"type"`
+	// How long the PDUs looked up may be reused across scrapes.
+	CacheTTL time.Duration `yaml:"cache_ttl,omitempty"`
 }
 
 // Secret is a string that must not be revealed on marshaling.
@@ -272,26 +367,72 @@ var (
 	DoNotHideSecrets = false
 )
 
+// What secrets are marshaled as, unless DoNotHideSecrets is set.
+const hiddenSecret = "<secret>"
+
 // MarshalYAML implements the yaml.Marshaler interface.
 func (s Secret) MarshalYAML() (interface{}, error) {
 	if DoNotHideSecrets {
 		return string(s), nil
 	}
 	if s != "" {
-		return "<secret>", nil
+		return hiddenSecret, nil
 	}
 	return nil, nil
 }
 
 type Auth struct {
-	Community     Secret `yaml:"community,omitempty"`
-	SecurityLevel string `yaml:"security_level,omitempty"`
-	Username      string `yaml:"username,omitempty"`
-	Password      Secret `yaml:"password,omitempty"`
-	AuthProtocol  string `yaml:"auth_protocol,omitempty"`
-	PrivProtocol  string `yaml:"priv_protocol,omitempty"`
-	PrivPassword  Secret `yaml:"priv_password,omitempty"`
-	ContextName   string `yaml:"context_name,omitempty"`
+	Community        Secret `yaml:"community,omitempty"`
+	CommunityFile    string `yaml:"community_file,omitempty"`
+	SecurityLevel    string `yaml:"security_level,omitempty"`
+	Username         string `yaml:"username,omitempty"`
+	Password         Secret `yaml:"password,omitempty"`
+	PasswordFile     string `yaml:"password_file,omitempty"`
+	AuthProtocol     string `yaml:"auth_protocol,omitempty"`
+	PrivProtocol     string `yaml:"priv_protocol,omitempty"`
+	PrivPassword     Secret `yaml:"priv_password,omitempty"`
+	PrivPasswordFile string `yaml:"priv_password_file,omitempty"`
+	ContextName      string `yaml:"context_name,omitempty"`
+}
+
+// References to environment variables in secrets.
+var envReference = regexp.MustCompile(`\$\{(\w+)\}`)
+
+// resolveSecrets reads the secrets that are given as a file, and replaces
+// ${VAR} references to environment variables in the others. A file takes
+// precedence over the secret itself.
+func (a *Auth) resolveSecrets() error {
+	for _, secret := range []struct {
+		value *Secret
+		file  string
+	}{
+		{&a.Community, a.CommunityFile},
+		{&a.Password, a.PasswordFile},
+		{&a.PrivPassword, a.PrivPasswordFile},
+	} {
+		if secret.file != "" {
+			content, err := ioutil.ReadFile(secret.file)
+			if err != nil {
+				return fmt.Errorf("Error reading secret file: %s", err)
+			}
+			*secret.value = Secret(strings.TrimRight(string(content), "\r\n"))
+			continue
+		}
+		var missing []string
+		expanded := envReference.ReplaceAllStringFunc(string(*secret.value), func(ref string) string {
+			name := envReference.FindStringSubmatch(ref)[1]
+			value, ok := os.LookupEnv(name)
+			if !ok {
+				missing = append(missing, name)
+			}
+			return value
+		})
+		if len(missing) > 0 {
+			return fmt.Errorf("Environment variables %v referenced by a secret are not set", missing)
+		}
+		*secret.value = Secret(expanded)
+	}
+	return nil
 }
 
 type RegexpExtract struct {
@@ -313,24 +454,45 @@ type Regexp struct {
 	*regexp.Regexp
 }
 
-// MarshalYAML implements the yaml.Marshaler interface.
+// MarshalYAML implements the yaml.Marshaler interface. The expression is
+// written without the anchors NewRegexp adds, so that reading it back gives
+// the same Regexp.
 func (re Regexp) MarshalYAML() (interface{}, error) {
 	if re.Regexp != nil {
-		return re.String(), nil
+		return regexpSource(re), nil
 	}
 	return nil, nil
 }
 
+// regexpSource returns the expression a Regexp was created from by
+// NewRegexp, without the anchors it adds.
+func regexpSource(re Regexp) string {
+	if re.Regexp == nil {
+		return ""
+	}
+	s := re.String()
+	if strings.HasPrefix(s, "^(?:") && strings.HasSuffix(s, ")$") {
+		return s[len("^(?:") : len(s)-len(")$")]
+	}
+	return s
+}
+
+// NewRegexp compiles s as a regular expression anchored at both ends.
+func NewRegexp(s string) (Regexp, error) {
+	regex, err := regexp.Compile("^(?:" + s + ")$")
+	return Regexp{Regexp: regex}, err
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
 	if err := unmarshal(&s); err != nil {
 		return err
 	}
-	regex, err := regexp.Compile("^(?:" + s + ")$")
+	regex, err := NewRegexp(s)
 	if err != nil {
 		return err
 	}
-	re.Regexp = regex
+	*re = regex
 	return nil
 }
@@ -0,0 +1,326 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// Resolve replaces each module that extends others with the effective
+// module. The parents are merged in the order given, followed by the module
+// itself:
+//
+//   - Walk and Get OIDs are added unless already present.
+//   - Metrics replace earlier metrics of the same name, org and sys, and are
+//     otherwise added.
+//   - Walk parameters that the module sets replace the ones so far, even if
+//     set to their default.
+//
+// Resolving an already resolved config changes nothing.
+func (c Config) Resolve() error {
+	r := resolver{raw: c, resolved: map[string]*Module{}}
+	for name := range c {
+		if _, err := r.resolve(name, nil); err != nil {
+			return err
+		}
+	}
+	for name, m := range r.resolved {
+		c[name] = m
+	}
+	return nil
+}
+
+// resolveEach is Resolve, but for each module on its own. The modules that
+// cannot be resolved, along with the modules extending them, are removed, and
+// their errors returned by module.
+func (c Config) resolveEach() map[string]error {
+	r := resolver{raw: c, resolved: map[string]*Module{}}
+	errs := map[string]error{}
+	for name := range c {
+		if _, err := r.resolve(name, nil); err != nil {
+			errs[name] = err
+		}
+	}
+	for name := range errs {
+		delete(c, name)
+	}
+	for name, m := range r.resolved {
+		c[name] = m
+	}
+	return errs
+}
+
+type resolver struct {
+	raw      Config
+	resolved map[string]*Module
+}
+
+// resolve returns the effective module, path being the modules that lead to
+// it through extends.
+func (r *resolver) resolve(name string, path []string) (*Module, error) {
+	if m, ok := r.resolved[name]; ok {
+		return m, nil
+	}
+	for i, n := range path {
+		if n == name {
+			return nil, fmt.Errorf("Module %s extends itself through %s", name, strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	own, ok := r.raw[name]
+	if !ok {
+		return nil, fmt.Errorf("Module %s extends unknown module %s", path[len(path)-1], name)
+	}
+	if len(own.Extends) == 0 {
+		r.resolved[name] = own
+		return own, nil
+	}
+
+	m := &Module{Extends: own.Extends, WalkParams: DefaultWalkParams}
+	for _, parentName := range own.Extends {
+		parent, err := r.resolve(parentName, append(path, name))
+		if err != nil {
+			return nil, err
+		}
+		m.merge(parent)
+	}
+	m.merge(own)
+	if err := m.WalkParams.Validate(); err != nil {
+		return nil, fmt.Errorf("Module %s: %s", name, err)
+	}
+	r.resolved[name] = m
+	return m, nil
+}
+
+// merge adds what other defines on top of c.
+func (c *Module) merge(other *Module) {
+	for _, oid := range other.Walk {
+		if !containsString(c.Walk, oid) {
+			c.Walk = append(c.Walk, oid)
+		}
+	}
+	for _, oid := range other.Get {
+		if !containsString(c.Get, oid) {
+			c.Get = append(c.Get, oid)
+		}
+	}
+MetricLoop:
+	for _, metric := range other.Metrics {
+		for i, m := range c.Metrics {
+			if m.Name == metric.Name && m.OrgID == metric.OrgID && m.SysID == metric.SysID {
+				c.Metrics[i] = metric
+				continue MetricLoop
+			}
+		}
+		c.Metrics = append(c.Metrics, metric)
+	}
+	c.WalkParams = c.WalkParams.overlay(other.WalkParams, other.setParams)
+	for name := range other.setParams {
+		if c.setParams == nil {
+			c.setParams = map[string]bool{}
+		}
+		c.setParams[name] = true
+	}
+}
+
+// The YAML names of the walk parameters a module can set.
+var (
+	walkParamNames = []string{"version", "max_repetitions", "retries", "timeout", "walk_concurrency", "partial_results"}
+	authParamNames = []string{
+		"community", "community_file", "security_level", "username", "password", "password_file",
+		"auth_protocol", "priv_protocol", "priv_password", "priv_password_file", "context_name",
+	}
+)
+
+// givenParams returns the walk parameters among the keys of a module in
+// YAML, nil if there are none. See Module.setParams.
+func givenParams(raw map[string]interface{}) map[string]bool {
+	var set map[string]bool
+	add := func(name string) {
+		if set == nil {
+			set = map[string]bool{}
+		}
+		set[name] = true
+	}
+	for _, name := range walkParamNames {
+		if _, ok := raw[name]; ok {
+			add(name)
+		}
+	}
+	if auth, ok := raw["auth"].(map[interface{}]interface{}); ok {
+		for _, name := range authParamNames {
+			if _, ok := auth[name]; ok {
+				add("auth." + name)
+			}
+		}
+	}
+	return set
+}
+
+// overlay returns c with the fields of top that are set. A secret and the
+// file to read it from are overlaid together, so that the one a module sets
+// is not shadowed by the other one of the modules it extends.
+func (c WalkParams) overlay(top WalkParams, set map[string]bool) WalkParams {
+	if set["version"] {
+		c.Version = top.Version
+	}
+	if set["max_repetitions"] {
+		c.MaxRepetitions = top.MaxRepetitions
+	}
+	if set["retries"] {
+		c.Retries = top.Retries
+	}
+	if set["timeout"] {
+		c.Timeout = top.Timeout
+	}
+	if set["walk_concurrency"] {
+		c.WalkConcurrency = top.WalkConcurrency
+	}
+	if set["partial_results"] {
+		c.PartialResults = top.PartialResults
+	}
+	if set["auth.community"] || set["auth.community_file"] {
+		c.Auth.Community = top.Auth.Community
+		c.Auth.CommunityFile = top.Auth.CommunityFile
+	}
+	if set["auth.security_level"] {
+		c.Auth.SecurityLevel = top.Auth.SecurityLevel
+	}
+	if set["auth.username"] {
+		c.Auth.Username = top.Auth.Username
+	}
+	if set["auth.password"] || set["auth.password_file"] {
+		c.Auth.Password = top.Auth.Password
+		c.Auth.PasswordFile = top.Auth.PasswordFile
+	}
+	if set["auth.auth_protocol"] {
+		c.Auth.AuthProtocol = top.Auth.AuthProtocol
+	}
+	if set["auth.priv_protocol"] {
+		c.Auth.PrivProtocol = top.Auth.PrivProtocol
+	}
+	if set["auth.priv_password"] || set["auth.priv_password_file"] {
+		c.Auth.PrivPassword = top.Auth.PrivPassword
+		c.Auth.PrivPasswordFile = top.Auth.PrivPasswordFile
+	}
+	if set["auth.context_name"] {
+		c.Auth.ContextName = top.Auth.ContextName
+	}
+	return c
+}
+
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// param returns the walk parameter of the YAML name, see Module.setParams.
+func (c WalkParams) param(name string) interface{} {
+	switch name {
+	case "version":
+		return c.Version
+	case "max_repetitions":
+		return c.MaxRepetitions
+	case "retries":
+		return c.Retries
+	case "timeout":
+		return c.Timeout
+	case "walk_concurrency":
+		return c.WalkConcurrency
+	case "partial_results":
+		return c.PartialResults
+	case "auth.community":
+		return c.Auth.Community
+	case "auth.community_file":
+		return c.Auth.CommunityFile
+	case "auth.security_level":
+		return c.Auth.SecurityLevel
+	case "auth.username":
+		return c.Auth.Username
+	case "auth.password":
+		return c.Auth.Password
+	case "auth.password_file":
+		return c.Auth.PasswordFile
+	case "auth.auth_protocol":
+		return c.Auth.AuthProtocol
+	case "auth.priv_protocol":
+		return c.Auth.PrivProtocol
+	case "auth.priv_password":
+		return c.Auth.PrivPassword
+	case "auth.priv_password_file":
+		return c.Auth.PrivPasswordFile
+	case "auth.context_name":
+		return c.Auth.ContextName
+	}
+	return nil
+}
+
+// RawConfig is a config as written, whose modules may extend others. Unlike
+// a Config it is marshaled with only the walk parameters each module sets,
+// even to their default, so that reading it back gives the same modules.
+type RawConfig Config
+
+// MarshalYAML implements the yaml.Marshaler interface.
+func (c RawConfig) MarshalYAML() (interface{}, error) {
+	names := make([]string, 0, len(c))
+	for name := range c {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	modules := yaml.MapSlice{}
+	for _, name := range names {
+		modules = append(modules, yaml.MapItem{Key: name, Value: c[name].rawYAML()})
+	}
+	return modules, nil
+}
+
+// rawYAML returns the module as written, see RawConfig.
+func (c *Module) rawYAML() yaml.MapSlice {
+	fields := yaml.MapSlice{}
+	add := func(fields *yaml.MapSlice, key string, value interface{}) {
+		*fields = append(*fields, yaml.MapItem{Key: key, Value: value})
+	}
+	if len(c.Extends) > 0 {
+		add(&fields, "extends", c.Extends)
+	}
+	if len(c.Walk) > 0 {
+		add(&fields, "walk", c.Walk)
+	}
+	if len(c.Get) > 0 {
+		add(&fields, "get", c.Get)
+	}
+	add(&fields, "metrics", c.Metrics)
+	for _, name := range walkParamNames {
+		if c.setParams[name] {
+			add(&fields, name, c.WalkParams.param(name))
+		}
+	}
+	auth := yaml.MapSlice{}
+	for _, name := range authParamNames {
+		if c.setParams["auth."+name] {
+			add(&auth, name, c.WalkParams.param("auth."+name))
+		}
+	}
+	if len(auth) > 0 {
+		add(&fields, "auth", auth)
+	}
+	return fields
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Merge combines the named modules into one that scrapes them all with a
+// single walk. Subtrees within other walked subtrees, and OIDs to get that
+// are walked anyway, are dropped.
+//
+// The modules must have the same walk parameters. A metric may be in
+// several of them, but different metrics may not share a name or OID.
+func (c Config) Merge(names []string) (*Module, error) {
+	// Metrics of different tenants may share a name or OID.
+	type metricKey struct {
+		id           string
+		orgID, sysID int
+	}
+	type seenMetric struct {
+		metric *Metric
+		module string
+	}
+	byName := map[metricKey]seenMetric{}
+	byOid := map[metricKey]seenMetric{}
+
+	merged := &Module{}
+	var walk, get []string
+	merging := map[string]bool{}
+	for i, name := range names {
+		// A module listed twice is merged once.
+		if merging[name] {
+			continue
+		}
+		merging[name] = true
+		m, ok := c[name]
+		if !ok {
+			return nil, fmt.Errorf("Unknown module '%s'", name)
+		}
+		if i == 0 {
+			merged.WalkParams = m.WalkParams
+		} else if m.WalkParams != merged.WalkParams {
+			return nil, fmt.Errorf("Modules '%s' and '%s' have different walk parameters", names[0], name)
+		}
+		walk = append(walk, m.Walk...)
+		get = append(get, m.Get...)
+		for _, metric := range m.Metrics {
+			nameKey := metricKey{metric.Name, metric.OrgID, metric.SysID}
+			oidKey := metricKey{metric.Oid, metric.OrgID, metric.SysID}
+			if seen, ok := byName[nameKey]; ok && seen.module != name {
+				if !reflect.DeepEqual(seen.metric, metric) {
+					return nil, fmt.Errorf("Metric %s of module '%s' conflicts with the one of module '%s'", metric.Name, name, seen.module)
+				}
+				continue
+			}
+			if seen, ok := byOid[oidKey]; ok && seen.module != name {
+				return nil, fmt.Errorf("Metric %s of module '%s' has the same OID as %s of module '%s'", metric.Name, name, seen.metric.Name, seen.module)
+			}
+			byName[nameKey] = seenMetric{metric, name}
+			byOid[oidKey] = seenMetric{metric, name}
+			merged.Metrics = append(merged.Metrics, metric)
+		}
+	}
+	merged.Walk = minimizeOids(walk)
+	for _, oid := range get {
+		if !merged.covers(oid) {
+			merged.Get = append(merged.Get, oid)
+		}
+	}
+	return merged, nil
+}
+
+// minimizeOids returns the OIDs without duplicates and without those within
+// the subtree of another.
+func minimizeOids(oids []string) []string {
+	sorted := append([]string(nil), oids...)
+	sort.Strings(sorted)
+	prevOid := ""
+	minimized := []string{}
+	for _, oid := range sorted {
+		if !strings.HasPrefix(oid+".", prevOid) || prevOid == "" {
+			minimized = append(minimized, oid)
+			prevOid = oid + "."
+		}
+	}
+	return minimized
+}
@@ -0,0 +1,655 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// Name the TLS settings are registered under with the MySQL driver.
+const mysqlTLSConfigName = "snmp_exporter"
+
+// Loads every module with its metrics in one round trip. Modules without
+// metrics are still returned, with NULL metric columns.
+const loadModulesQuery = `
+SELECT m.module, c.id, c.name, c.oid, c.type, c.help, c.request_type, c.org_id, c.sys_id,
+       c.cache_ttl_seconds
+FROM cw_hardware_module m
+LEFT JOIN cw_snmp_custom_metrics c ON c.module = m.module
+ORDER BY m.module, c.id`
+
+// The walk parameters and credentials of the profile assigned to each module.
+// The secret columns hold values encrypted with a SecretKey, the *_file
+// columns files to read them from instead.
+const loadWalkParamsQuery = `
+SELECT mp.module, p.version, p.max_repetitions, p.retries, p.timeout_seconds,
+       p.community, p.security_level, p.username, p.password,
+       p.auth_protocol, p.priv_protocol, p.priv_password, p.context_name,
+       p.community_file, p.password_file, p.priv_password_file,
+       p.walk_concurrency, p.partial_results
+FROM cw_snmp_module_profiles mp
+JOIN cw_snmp_credential_profiles p ON p.id = mp.profile_id`
+
+// The modules each module extends, in the order they are merged.
+const loadExtendsQuery = `
+SELECT module, parent
+FROM cw_snmp_module_extends
+ORDER BY module, position`
+
+// The OIDs each module walks and gets, as imported from a config file.
+const loadModuleOidsQuery = `
+SELECT module, request_type, oid
+FROM cw_snmp_module_oids
+ORDER BY module, position`
+
+// The companion tables of cw_snmp_custom_metrics, kept in definition order.
+const (
+	loadIndexesQuery = `
+SELECT metric_id, labelname, type, fixed_size
+FROM cw_snmp_custom_metric_indexes
+ORDER BY metric_id, position`
+	loadLookupsQuery = `
+SELECT metric_id, labels, labelname, oid, type, cache_ttl_seconds
+FROM cw_snmp_custom_metric_lookups
+ORDER BY metric_id, position`
+	loadRegexpExtractsQuery = `
+SELECT metric_id, name, regex, value
+FROM cw_snmp_custom_metric_regex_extracts
+ORDER BY metric_id, position`
+)
+
+// MySQLConfig holds the settings for connecting to the configuration database.
+type MySQLConfig struct {
+	// DSN in the go-sql-driver/mysql format, e.g. user:pass@tcp(host:3306)/db.
+	DSN string
+	// File to read the DSN from, if DSN is empty.
+	DSNFile string
+
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime time.Duration
+	// Timeout applies to connecting and to each load of the configuration.
+	Timeout time.Duration
+
+	// Base64 key, or a file holding it, to decrypt the secrets of the
+	// credential profiles with. See SecretKey.
+	SecretKey     string
+	SecretKeyFile string
+}
+
+// MySQLSource builds the configuration from the cw_hardware_module and
+// cw_snmp_custom_metrics tables, and the index, lookup and regex extract
+// tables hanging off the metrics.
+type MySQLSource struct {
+	db        *sql.DB
+	timeout   time.Duration
+	name      string
+	secretKey *SecretKey
+
+	mtx   sync.Mutex
+	stmts map[string]*sql.Stmt
+}
+
+// NewMySQLSource sets up the connection pool for the configuration database.
+// No connection is made until the first Load.
+func NewMySQLSource(cfg MySQLConfig) (*MySQLSource, error) {
+	rawDSN := cfg.DSN
+	if rawDSN == "" && cfg.DSNFile != "" {
+		content, err := ioutil.ReadFile(cfg.DSNFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading MySQL DSN file: %s", err)
+		}
+		rawDSN = strings.TrimSpace(string(content))
+	}
+	if rawDSN == "" {
+		return nil, fmt.Errorf("No MySQL DSN configured")
+	}
+	dsn, err := mysql.ParseDSN(rawDSN)
+	if err != nil {
+		return nil, fmt.Errorf("Error parsing MySQL DSN: %s", err)
+	}
+
+	if cfg.TLSCAFile != "" || cfg.TLSCertFile != "" || cfg.TLSInsecureSkipVerify || cfg.TLSServerName != "" {
+		tlsConfig, err := cfg.tlsConfig()
+		if err != nil {
+			return nil, err
+		}
+		if err := mysql.RegisterTLSConfig(mysqlTLSConfigName, tlsConfig); err != nil {
+			return nil, err
+		}
+		dsn.TLSConfig = mysqlTLSConfigName
+	}
+	if dsn.Timeout == 0 {
+		dsn.Timeout = cfg.Timeout
+	}
+
+	var secretKey *SecretKey
+	switch {
+	case cfg.SecretKey != "":
+		secretKey, err = ParseSecretKey(cfg.SecretKey)
+	case cfg.SecretKeyFile != "":
+		secretKey, err = LoadSecretKeyFile(cfg.SecretKeyFile)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Error loading secret key: %s", err)
+	}
+
+	db, err := sql.Open("mysql", dsn.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(cfg.MaxOpenConns)
+	db.SetMaxIdleConns(cfg.MaxIdleConns)
+	db.SetConnMaxLifetime(cfg.ConnMaxLifetime)
+
+	return &MySQLSource{
+		db:        db,
+		timeout:   cfg.Timeout,
+		name:      fmt.Sprintf("mysql %s/%s", dsn.Addr, dsn.DBName),
+		secretKey: secretKey,
+		stmts:     map[string]*sql.Stmt{},
+	}, nil
+}
+
+func (c MySQLConfig) tlsConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+	}
+	if c.TLSCAFile != "" {
+		pem, err := ioutil.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error reading MySQL CA file: %s", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in MySQL CA file %s", c.TLSCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+	if c.TLSCertFile != "" || c.TLSKeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Error loading MySQL client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+func (s *MySQLSource) Load() (*Config, error) {
+	cfg, err := s.load(true)
+	if err != nil {
+		return nil, err
+	}
+	for _, m := range cfg {
+		m.walkLookups()
+	}
+	if err := cfg.Resolve(); err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
+
+// load reads the modules as stored, without resolving the modules that
+// extend others. Unless secrets is set, the secrets of the credential
+// profiles are only decrypted, keeping the references to files and
+// environment variables.
+func (s *MySQLSource) load(secrets bool) (Config, error) {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	if err := s.db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("Error connecting to database: %s", err)
+	}
+	if err := s.checkSchema(ctx); err != nil {
+		return nil, err
+	}
+
+	cfg, metrics, err := s.loadModules(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.loadIndexes(ctx, metrics); err != nil {
+		return nil, err
+	}
+	if err := s.loadLookups(ctx, metrics); err != nil {
+		return nil, err
+	}
+	if err := s.loadRegexpExtracts(ctx, metrics); err != nil {
+		return nil, err
+	}
+	if err := s.loadModuleOids(ctx, cfg); err != nil {
+		return nil, err
+	}
+	if err := s.loadExtends(ctx, cfg); err != nil {
+		return nil, err
+	}
+	if err := s.loadWalkParams(ctx, cfg, secrets); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// loadModules reads the modules and their metrics. The metrics are also
+// returned by id, so that their indexes and lookups can be attached.
+func (s *MySQLSource) loadModules(ctx context.Context) (Config, map[int64]*Metric, error) {
+	rows, err := s.query(ctx, loadModulesQuery)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Error querying modules: %s", err)
+	}
+	defer rows.Close()
+
+	cfg := Config{}
+	metrics := map[int64]*Metric{}
+	for rows.Next() {
+		var (
+			module      string
+			metricID    sql.NullInt64
+			name        sql.NullString
+			oid         sql.NullString
+			metricType  sql.NullString
+			help        sql.NullString
+			requestType sql.NullString
+			orgID       sql.NullInt64
+			sysID       sql.NullInt64
+			cacheTTL    sql.NullFloat64
+		)
+		if err := rows.Scan(&module, &metricID, &name, &oid, &metricType, &help, &requestType, &orgID, &sysID, &cacheTTL); err != nil {
+			return nil, nil, fmt.Errorf("Error reading modules: %s", err)
+		}
+		m, ok := cfg[module]
+		if !ok {
+			m = &Module{WalkParams: DefaultWalkParams}
+			cfg[module] = m
+		}
+		// Modules without any metrics come back as a single row of NULLs.
+		if !metricID.Valid {
+			continue
+		}
+		switch requestType.String {
+		case "walk":
+			m.Walk = append(m.Walk, oid.String)
+		case "get":
+			m.Get = append(m.Get, oid.String)
+		}
+		metric := &Metric{
+			Name:     name.String,
+			Oid:      oid.String,
+			Type:     metricType.String,
+			Help:     help.String,
+			OrgID:    int(orgID.Int64),
+			SysID:    int(sysID.Int64),
+			CacheTTL: time.Duration(cacheTTL.Float64 * float64(time.Second)),
+		}
+		m.Metrics = append(m.Metrics, metric)
+		metrics[metricID.Int64] = metric
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("Error reading modules: %s", err)
+	}
+	return cfg, metrics, nil
+}
+
+func (s *MySQLSource) loadIndexes(ctx context.Context, metrics map[int64]*Metric) error {
+	rows, err := s.query(ctx, loadIndexesQuery)
+	if err != nil {
+		return fmt.Errorf("Error querying indexes: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metricID int64
+		index := &Index{}
+		if err := rows.Scan(&metricID, &index.Labelname, &index.Type, &index.FixedSize); err != nil {
+			return fmt.Errorf("Error reading indexes: %s", err)
+		}
+		if metric, ok := metrics[metricID]; ok {
+			metric.Indexes = append(metric.Indexes, index)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading indexes: %s", err)
+	}
+	return nil
+}
+
+func (s *MySQLSource) loadLookups(ctx context.Context, metrics map[int64]*Metric) error {
+	rows, err := s.query(ctx, loadLookupsQuery)
+	if err != nil {
+		return fmt.Errorf("Error querying lookups: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metricID int64
+		var labels string
+		var cacheTTL float64
+		lookup := &Lookup{}
+		if err := rows.Scan(&metricID, &labels, &lookup.Labelname, &lookup.Oid, &lookup.Type, &cacheTTL); err != nil {
+			return fmt.Errorf("Error reading lookups: %s", err)
+		}
+		lookup.CacheTTL = time.Duration(cacheTTL * float64(time.Second))
+		for _, label := range strings.Split(labels, ",") {
+			if label = strings.TrimSpace(label); label != "" {
+				lookup.Labels = append(lookup.Labels, label)
+			}
+		}
+		if metric, ok := metrics[metricID]; ok {
+			metric.Lookups = append(metric.Lookups, lookup)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading lookups: %s", err)
+	}
+	return nil
+}
+
+func (s *MySQLSource) loadRegexpExtracts(ctx context.Context, metrics map[int64]*Metric) error {
+	rows, err := s.query(ctx, loadRegexpExtractsQuery)
+	if err != nil {
+		return fmt.Errorf("Error querying regex extracts: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var metricID int64
+		var name, regex string
+		var value sql.NullString
+		if err := rows.Scan(&metricID, &name, &regex, &value); err != nil {
+			return fmt.Errorf("Error reading regex extracts: %s", err)
+		}
+		metric, ok := metrics[metricID]
+		if !ok {
+			continue
+		}
+		re, err := NewRegexp(regex)
+		if err != nil {
+			return fmt.Errorf("Invalid regex extract %q for metric %s: %s", regex, metric.Name, err)
+		}
+		extract := DefaultRegexpExtract
+		extract.Regex = re
+		if value.String != "" {
+			extract.Value = value.String
+		}
+		if metric.RegexpExtracts == nil {
+			metric.RegexpExtracts = map[string][]RegexpExtract{}
+		}
+		metric.RegexpExtracts[name] = append(metric.RegexpExtracts[name], extract)
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading regex extracts: %s", err)
+	}
+	return nil
+}
+
+// loadModuleOids sets the walked and fetched OIDs of the modules that list
+// them. The OIDs of their metrics are kept only where the listed ones do not
+// cover them, as for metrics added after the module was imported.
+func (s *MySQLSource) loadModuleOids(ctx context.Context, cfg Config) error {
+	rows, err := s.query(ctx, loadModuleOidsQuery)
+	if err != nil {
+		return fmt.Errorf("Error querying module OIDs: %s", err)
+	}
+	defer rows.Close()
+	listed := map[string]*Module{}
+	for rows.Next() {
+		var module, requestType, oid string
+		if err := rows.Scan(&module, &requestType, &oid); err != nil {
+			return fmt.Errorf("Error reading module OIDs: %s", err)
+		}
+		if _, ok := cfg[module]; !ok {
+			continue
+		}
+		l, ok := listed[module]
+		if !ok {
+			l = &Module{}
+			listed[module] = l
+		}
+		switch requestType {
+		case "walk":
+			l.Walk = append(l.Walk, oid)
+		case "get":
+			l.Get = append(l.Get, oid)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading module OIDs: %s", err)
+	}
+	for module, l := range listed {
+		m := cfg[module]
+		for _, oid := range m.Walk {
+			if !l.covers(oid) {
+				l.Walk = append(l.Walk, oid)
+			}
+		}
+		for _, oid := range m.Get {
+			if !l.covers(oid) && !l.getsWithin(oid) {
+				l.Get = append(l.Get, oid)
+			}
+		}
+		m.Walk, m.Get = l.Walk, l.Get
+	}
+	return nil
+}
+
+func (s *MySQLSource) loadExtends(ctx context.Context, cfg Config) error {
+	rows, err := s.query(ctx, loadExtendsQuery)
+	if err != nil {
+		return fmt.Errorf("Error querying module extends: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var module, parent string
+		if err := rows.Scan(&module, &parent); err != nil {
+			return fmt.Errorf("Error reading module extends: %s", err)
+		}
+		if m, ok := cfg[module]; ok {
+			m.Extends = append(m.Extends, parent)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading module extends: %s", err)
+	}
+	return nil
+}
+
+// loadWalkParams applies the credential profiles assigned to modules.
+// Modules without a profile keep the DefaultWalkParams. With secrets, the
+// secrets are read from their files and environment variables, and the
+// profiles are checked.
+func (s *MySQLSource) loadWalkParams(ctx context.Context, cfg Config, secrets bool) error {
+	rows, err := s.query(ctx, loadWalkParamsQuery)
+	if err != nil {
+		return fmt.Errorf("Error querying credential profiles: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var (
+			module         string
+			version        sql.NullInt64
+			maxRepetitions sql.NullInt64
+			retries        sql.NullInt64
+			timeout        sql.NullFloat64
+			community      sql.NullString
+			securityLevel  sql.NullString
+			username       sql.NullString
+			password       sql.NullString
+			authProtocol   sql.NullString
+			privProtocol   sql.NullString
+			privPassword   sql.NullString
+			contextName    sql.NullString
+			communityFile  sql.NullString
+			passwordFile   sql.NullString
+			privPassFile   sql.NullString
+			concurrency    sql.NullInt64
+			partial        sql.NullBool
+		)
+		if err := rows.Scan(&module, &version, &maxRepetitions, &retries, &timeout,
+			&community, &securityLevel, &username, &password,
+			&authProtocol, &privProtocol, &privPassword, &contextName,
+			&communityFile, &passwordFile, &privPassFile,
+			&concurrency, &partial); err != nil {
+			return fmt.Errorf("Error reading credential profiles: %s", err)
+		}
+		m, ok := cfg[module]
+		if !ok {
+			continue
+		}
+
+		wp := DefaultWalkParams
+		if version.Valid {
+			wp.Version = int(version.Int64)
+		}
+		if maxRepetitions.Valid {
+			wp.MaxRepetitions = uint8(maxRepetitions.Int64)
+		}
+		if retries.Valid {
+			wp.Retries = int(retries.Int64)
+		}
+		if timeout.Valid {
+			wp.Timeout = time.Duration(timeout.Float64 * float64(time.Second))
+		}
+		if concurrency.Valid {
+			wp.WalkConcurrency = int(concurrency.Int64)
+		}
+		if partial.Valid {
+			wp.PartialResults = partial.Bool
+		}
+		if securityLevel.Valid {
+			wp.Auth.SecurityLevel = securityLevel.String
+		}
+		if username.Valid {
+			wp.Auth.Username = username.String
+		}
+		if authProtocol.Valid {
+			wp.Auth.AuthProtocol = authProtocol.String
+		}
+		if privProtocol.Valid {
+			wp.Auth.PrivProtocol = privProtocol.String
+		}
+		if contextName.Valid {
+			wp.Auth.ContextName = contextName.String
+		}
+		wp.Auth.CommunityFile = communityFile.String
+		wp.Auth.PasswordFile = passwordFile.String
+		wp.Auth.PrivPasswordFile = privPassFile.String
+		for _, secret := range []struct {
+			column sql.NullString
+			field  *Secret
+		}{
+			{community, &wp.Auth.Community},
+			{password, &wp.Auth.Password},
+			{privPassword, &wp.Auth.PrivPassword},
+		} {
+			if !secret.column.Valid {
+				continue
+			}
+			if secret.column.String == "" {
+				*secret.field = ""
+				continue
+			}
+			if s.secretKey == nil {
+				return fmt.Errorf("Credential profile of module %s has encrypted secrets, but no secret key is configured", module)
+			}
+			value, err := s.secretKey.Decrypt(secret.column.String)
+			if err != nil {
+				return fmt.Errorf("Credential profile of module %s: %s", module, err)
+			}
+			*secret.field = value
+		}
+		if secrets {
+			if err := wp.Auth.resolveSecrets(); err != nil {
+				return fmt.Errorf("Credential profile of module %s: %s", module, err)
+			}
+			// Modules that extend others are validated once resolved.
+			if len(m.Extends) == 0 {
+				if err := wp.Validate(); err != nil {
+					return fmt.Errorf("Invalid credential profile for module %s: %s", module, err)
+				}
+			}
+		}
+		m.WalkParams = wp
+		// The columns that are not NULL are the walk parameters the module sets.
+		m.setParams = nil
+		for name, valid := range map[string]bool{
+			"version":                 version.Valid,
+			"max_repetitions":         maxRepetitions.Valid,
+			"retries":                 retries.Valid,
+			"timeout":                 timeout.Valid,
+			"walk_concurrency":        concurrency.Valid,
+			"partial_results":         partial.Valid,
+			"auth.community":          community.Valid,
+			"auth.community_file":     communityFile.Valid,
+			"auth.security_level":     securityLevel.Valid,
+			"auth.username":           username.Valid,
+			"auth.password":           password.Valid,
+			"auth.password_file":      passwordFile.Valid,
+			"auth.auth_protocol":      authProtocol.Valid,
+			"auth.priv_protocol":      privProtocol.Valid,
+			"auth.priv_password":      privPassword.Valid,
+			"auth.priv_password_file": privPassFile.Valid,
+			"auth.context_name":       contextName.Valid,
+		} {
+			if !valid {
+				continue
+			}
+			if m.setParams == nil {
+				m.setParams = map[string]bool{}
+			}
+			m.setParams[name] = true
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading credential profiles: %s", err)
+	}
+	return nil
+}
+
+// query runs a statement, preparing it on first use.
+func (s *MySQLSource) query(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	s.mtx.Lock()
+	stmt, ok := s.stmts[query]
+	if !ok {
+		var err error
+		stmt, err = s.db.PrepareContext(ctx, query)
+		if err != nil {
+			s.mtx.Unlock()
+			return nil, err
+		}
+		s.stmts[query] = stmt
+	}
+	s.mtx.Unlock()
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (s *MySQLSource) String() string {
+	return s.name
+}
@@ -0,0 +1,340 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// Metrics are matched between a config file and the database on these.
+type metricKey struct {
+	oid   string
+	orgID int
+	sysID int
+}
+
+// Import upserts the modules of cfg into the database, in one transaction.
+// Modules are matched by name, and metrics by module, OID, org and sys. The
+// OIDs the modules walk and get, and the indexes, lookups and regex extracts
+// of the imported metrics are replaced.
+// With prune, the metrics of imported modules that are not in cfg are
+// deleted.
+//
+// Modules that set walk parameters are given a credential profile named after
+// the module, unless the profile they already have is the same. Secrets are
+// stored as given, so cfg should be read with ReadRawFile to keep referring
+// to files and environment variables rather than to store what they hold.
+func (s *MySQLSource) Import(cfg Config, prune bool) error {
+	current, err := s.load(false)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if err := importModule(ctx, tx, name, cfg[name], prune); err != nil {
+			return fmt.Errorf("Error importing module %s: %s", name, err)
+		}
+		if old, ok := current[name]; ok && old.WalkParams == cfg[name].WalkParams && reflect.DeepEqual(old.setParams, cfg[name].setParams) {
+			continue
+		}
+		if err := s.importWalkParams(ctx, tx, name, cfg[name]); err != nil {
+			return fmt.Errorf("Error importing walk parameters of module %s: %s", name, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Export reads the modules as stored, to be written out as a config file
+// that Import takes back unchanged. Modules keep the modules they extend, and
+// secrets their references to files and environment variables.
+func (s *MySQLSource) Export() (RawConfig, error) {
+	cfg, err := s.load(false)
+	if err != nil {
+		return nil, err
+	}
+	return RawConfig(cfg), nil
+}
+
+func importModule(ctx context.Context, tx *sql.Tx, name string, m *Module, prune bool) error {
+	var moduleID int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM cw_hardware_module WHERE module = ?`, name).Scan(&moduleID)
+	if err == sql.ErrNoRows {
+		_, err = tx.ExecContext(ctx, `INSERT INTO cw_hardware_module (module, name) VALUES (?, ?)`, name, name)
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cw_snmp_module_extends WHERE module = ?`, name); err != nil {
+		return err
+	}
+	for i, parent := range m.Extends {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_module_extends (module, position, parent) VALUES (?, ?, ?)`,
+			name, i, parent); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM cw_snmp_module_oids WHERE module = ?`, name); err != nil {
+		return err
+	}
+	position := 0
+	for _, oids := range []struct {
+		requestType string
+		list        []string
+	}{{"walk", m.Walk}, {"get", m.Get}} {
+		for _, oid := range oids.list {
+			if _, err := tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_module_oids (module, position, request_type, oid) VALUES (?, ?, ?, ?)`,
+				name, position, oids.requestType, oid); err != nil {
+				return err
+			}
+			position++
+		}
+	}
+
+	existing, err := moduleMetrics(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+	kept := map[int64]bool{}
+	for _, metric := range m.Metrics {
+		// The OIDs to get are the instances of the metrics, such as <oid>.0.
+		requestType := "walk"
+		if m.getsWithin(metric.Oid) {
+			requestType = "get"
+		}
+		id, ok := existing[metricKey{metric.Oid, metric.OrgID, metric.SysID}]
+		if ok {
+			_, err = tx.ExecContext(ctx, `
+UPDATE cw_snmp_custom_metrics SET name = ?, type = ?, help = ?, request_type = ?, cache_ttl_seconds = ? WHERE id = ?`,
+				metric.Name, metric.Type, metric.Help, requestType, metric.CacheTTL.Seconds(), id)
+		} else {
+			var res sql.Result
+			res, err = tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_custom_metrics (name, oid, type, help, request_type, module, org_id, sys_id, cache_ttl_seconds)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+				metric.Name, metric.Oid, metric.Type, metric.Help, requestType, name, metric.OrgID, metric.SysID, metric.CacheTTL.Seconds())
+			if err == nil {
+				id, err = res.LastInsertId()
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("metric %s: %s", metric.Name, err)
+		}
+		kept[id] = true
+		if err := importMetricDetails(ctx, tx, id, metric); err != nil {
+			return fmt.Errorf("metric %s: %s", metric.Name, err)
+		}
+	}
+
+	if !prune {
+		return nil
+	}
+	for _, id := range existing {
+		if kept[id] {
+			continue
+		}
+		if err := deleteMetricDetails(ctx, tx, id); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, `DELETE FROM cw_snmp_custom_metrics WHERE id = ?`, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moduleMetrics returns the ids of the metrics a module has in the database.
+func moduleMetrics(ctx context.Context, tx *sql.Tx, module string) (map[metricKey]int64, error) {
+	rows, err := tx.QueryContext(ctx, `SELECT id, oid, org_id, sys_id FROM cw_snmp_custom_metrics WHERE module = ?`, module)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := map[metricKey]int64{}
+	for rows.Next() {
+		var id int64
+		var key metricKey
+		if err := rows.Scan(&id, &key.oid, &key.orgID, &key.sysID); err != nil {
+			return nil, err
+		}
+		ids[key] = id
+	}
+	return ids, rows.Err()
+}
+
+// importMetricDetails replaces the indexes, lookups and regex extracts of a
+// metric.
+func importMetricDetails(ctx context.Context, tx *sql.Tx, id int64, metric *Metric) error {
+	if err := deleteMetricDetails(ctx, tx, id); err != nil {
+		return err
+	}
+	for i, index := range metric.Indexes {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_custom_metric_indexes (metric_id, position, labelname, type, fixed_size)
+VALUES (?, ?, ?, ?, ?)`,
+			id, i, index.Labelname, index.Type, index.FixedSize); err != nil {
+			return err
+		}
+	}
+	for i, lookup := range metric.Lookups {
+		if _, err := tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_custom_metric_lookups (metric_id, position, labels, labelname, oid, type, cache_ttl_seconds)
+VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			id, i, strings.Join(lookup.Labels, ","), lookup.Labelname, lookup.Oid, lookup.Type, lookup.CacheTTL.Seconds()); err != nil {
+			return err
+		}
+	}
+	names := make([]string, 0, len(metric.RegexpExtracts))
+	for name := range metric.RegexpExtracts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	position := 0
+	for _, name := range names {
+		for _, extract := range metric.RegexpExtracts[name] {
+			if _, err := tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_custom_metric_regex_extracts (metric_id, position, name, regex, value)
+VALUES (?, ?, ?, ?, ?)`,
+				id, position, name, regexpSource(extract.Regex), extract.Value); err != nil {
+				return err
+			}
+			position++
+		}
+	}
+	return nil
+}
+
+func deleteMetricDetails(ctx context.Context, tx *sql.Tx, id int64) error {
+	for _, table := range []string{
+		"cw_snmp_custom_metric_indexes",
+		"cw_snmp_custom_metric_lookups",
+		"cw_snmp_custom_metric_regex_extracts",
+	} {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM "+table+" WHERE metric_id = ?", id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// importWalkParams assigns the module a credential profile named after it
+// with the walk parameters it sets, leaving the others NULL, or none if it
+// sets none.
+func (s *MySQLSource) importWalkParams(ctx context.Context, tx *sql.Tx, module string, m *Module) error {
+	if len(m.setParams) == 0 {
+		_, err := tx.ExecContext(ctx, `DELETE FROM cw_snmp_module_profiles WHERE module = ?`, module)
+		return err
+	}
+	wp := m.WalkParams
+	param := func(name string, value interface{}) interface{} {
+		if !m.setParams[name] {
+			return nil
+		}
+		return value
+	}
+	var secrets [3]interface{}
+	for i, secret := range []struct {
+		name  string
+		value Secret
+	}{
+		{"auth.community", wp.Auth.Community},
+		{"auth.password", wp.Auth.Password},
+		{"auth.priv_password", wp.Auth.PrivPassword},
+	} {
+		if !m.setParams[secret.name] {
+			continue
+		}
+		if secret.value == hiddenSecret {
+			return fmt.Errorf("The %s is %s, as exported without showing the secrets", secret.name, hiddenSecret)
+		}
+		if s.secretKey == nil {
+			return fmt.Errorf("No secret key is configured to encrypt the credentials with")
+		}
+		encrypted, err := s.secretKey.Encrypt(secret.value)
+		if err != nil {
+			return err
+		}
+		secrets[i] = encrypted
+	}
+	args := []interface{}{
+		param("version", wp.Version), param("max_repetitions", wp.MaxRepetitions),
+		param("retries", wp.Retries), param("timeout", wp.Timeout.Seconds()),
+		secrets[0], param("auth.security_level", wp.Auth.SecurityLevel),
+		param("auth.username", wp.Auth.Username), secrets[1],
+		param("auth.auth_protocol", wp.Auth.AuthProtocol), param("auth.priv_protocol", wp.Auth.PrivProtocol),
+		secrets[2], param("auth.context_name", wp.Auth.ContextName),
+		param("auth.community_file", wp.Auth.CommunityFile), param("auth.password_file", wp.Auth.PasswordFile),
+		param("auth.priv_password_file", wp.Auth.PrivPasswordFile),
+		param("walk_concurrency", wp.WalkConcurrency), param("partial_results", wp.PartialResults),
+	}
+
+	var profileID int64
+	err := tx.QueryRowContext(ctx, `SELECT id FROM cw_snmp_credential_profiles WHERE name = ?`, module).Scan(&profileID)
+	switch err {
+	case nil:
+		_, err = tx.ExecContext(ctx, `
+UPDATE cw_snmp_credential_profiles
+SET version = ?, max_repetitions = ?, retries = ?, timeout_seconds = ?,
+    community = ?, security_level = ?, username = ?, password = ?,
+    auth_protocol = ?, priv_protocol = ?, priv_password = ?, context_name = ?,
+    community_file = ?, password_file = ?, priv_password_file = ?,
+    walk_concurrency = ?, partial_results = ?
+WHERE id = ?`, append(args, profileID)...)
+	case sql.ErrNoRows:
+		var res sql.Result
+		res, err = tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_credential_profiles
+  (name, version, max_repetitions, retries, timeout_seconds,
+   community, security_level, username, password,
+   auth_protocol, priv_protocol, priv_password, context_name,
+   community_file, password_file, priv_password_file, walk_concurrency,
+   partial_results)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, append([]interface{}{module}, args...)...)
+		if err == nil {
+			profileID, err = res.LastInsertId()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, err = tx.ExecContext(ctx, `
+INSERT INTO cw_snmp_module_profiles (module, profile_id) VALUES (?, ?)
+ON DUPLICATE KEY UPDATE profile_id = VALUES(profile_id)`, module, profileID)
+	return err
+}
@@ -0,0 +1,256 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+// migration is one step of the database schema. Its statements are applied
+// in order. The first migrations predate versioning, so they must be safe to
+// apply to a database that already has the tables.
+type migration struct {
+	description string
+	statements  []string
+}
+
+// migrations brings the schema from version i to i+1 with migrations[i].
+// Only ever append to it.
+var migrations = []migration{
+	{
+		description: "hardware modules and their metrics",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS cw_hardware_module (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  category_id INT NOT NULL DEFAULT 0,
+  module VARCHAR(255) NOT NULL,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  remark VARCHAR(255) NOT NULL DEFAULT '',
+  icon VARCHAR(255) NOT NULL DEFAULT ''
+)`, `
+CREATE TABLE IF NOT EXISTS cw_snmp_custom_metrics (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(255) NOT NULL,
+  oid VARCHAR(255) NOT NULL,
+  type VARCHAR(64) NOT NULL,
+  help TEXT NOT NULL,
+  request_type VARCHAR(16) NOT NULL,
+  module VARCHAR(255) NOT NULL,
+  org_id INT NOT NULL DEFAULT 0,
+  sys_id INT NOT NULL DEFAULT 0,
+  KEY module (module)
+)`},
+	},
+	{
+		description: "indexes, lookups and regex extracts of metrics",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS cw_snmp_custom_metric_indexes (
+  metric_id INT NOT NULL,
+  position INT NOT NULL,
+  labelname VARCHAR(255) NOT NULL,
+  type VARCHAR(64) NOT NULL,
+  fixed_size INT NOT NULL DEFAULT 0,
+  PRIMARY KEY (metric_id, position)
+)`, `
+CREATE TABLE IF NOT EXISTS cw_snmp_custom_metric_lookups (
+  metric_id INT NOT NULL,
+  position INT NOT NULL,
+  labels VARCHAR(1024) NOT NULL,
+  labelname VARCHAR(255) NOT NULL,
+  oid VARCHAR(255) NOT NULL,
+  type VARCHAR(64) NOT NULL,
+  PRIMARY KEY (metric_id, position)
+)`, `
+CREATE TABLE IF NOT EXISTS cw_snmp_custom_metric_regex_extracts (
+  metric_id INT NOT NULL,
+  position INT NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  regex TEXT NOT NULL,
+  value VARCHAR(255) NULL,
+  PRIMARY KEY (metric_id, position)
+)`},
+	},
+	{
+		description: "credential profiles",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS cw_snmp_credential_profiles (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  name VARCHAR(255) NOT NULL DEFAULT '',
+  version INT NULL,
+  max_repetitions INT NULL,
+  retries INT NULL,
+  timeout_seconds DOUBLE NULL,
+  community TEXT NULL,
+  security_level VARCHAR(32) NULL,
+  username VARCHAR(255) NULL,
+  password TEXT NULL,
+  auth_protocol VARCHAR(16) NULL,
+  priv_protocol VARCHAR(16) NULL,
+  priv_password TEXT NULL,
+  context_name VARCHAR(255) NULL
+)`, `
+CREATE TABLE IF NOT EXISTS cw_snmp_module_profiles (
+  module VARCHAR(255) NOT NULL PRIMARY KEY,
+  profile_id INT NOT NULL
+)`},
+	},
+	{
+		description: "module inheritance",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS cw_snmp_module_extends (
+  module VARCHAR(255) NOT NULL,
+  position INT NOT NULL,
+  parent VARCHAR(255) NOT NULL,
+  PRIMARY KEY (module, position)
+)`},
+	},
+	{
+		description: "secrets read from files",
+		statements: []string{`
+ALTER TABLE cw_snmp_credential_profiles
+  ADD COLUMN community_file VARCHAR(1024) NULL,
+  ADD COLUMN password_file VARCHAR(1024) NULL,
+  ADD COLUMN priv_password_file VARCHAR(1024) NULL`},
+	},
+	{
+		description: "parallel walks",
+		statements: []string{`
+ALTER TABLE cw_snmp_credential_profiles
+  ADD COLUMN walk_concurrency INT NULL`},
+	},
+	{
+		description: "partial results",
+		statements: []string{`
+ALTER TABLE cw_snmp_credential_profiles
+  ADD COLUMN partial_results BOOLEAN NULL`},
+	},
+	{
+		description: "cached metrics and lookups",
+		statements: []string{`
+ALTER TABLE cw_snmp_custom_metrics
+  ADD COLUMN cache_ttl_seconds DOUBLE NOT NULL DEFAULT 0`, `
+ALTER TABLE cw_snmp_custom_metric_lookups
+  ADD COLUMN cache_ttl_seconds DOUBLE NOT NULL DEFAULT 0`},
+	},
+	{
+		description: "targets to poll",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS cw_snmp_poll_targets (
+  id INT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  target VARCHAR(255) NOT NULL,
+  module VARCHAR(1024) NOT NULL,
+  org_id INT NOT NULL DEFAULT 0,
+  sys_id INT NOT NULL DEFAULT 0,
+  interval_seconds DOUBLE NOT NULL DEFAULT 0
+)`},
+	},
+	{
+		description: "walked and fetched OIDs of modules",
+		statements: []string{`
+CREATE TABLE IF NOT EXISTS cw_snmp_module_oids (
+  module VARCHAR(255) NOT NULL,
+  position INT NOT NULL,
+  request_type VARCHAR(16) NOT NULL,
+  oid VARCHAR(255) NOT NULL,
+  PRIMARY KEY (module, position)
+)`},
+	},
+}
+
+// SchemaVersion is the version of the database schema this exporter reads.
+var SchemaVersion = len(migrations)
+
+const (
+	createSchemaVersionTable = `
+CREATE TABLE IF NOT EXISTS cw_snmp_schema_migrations (
+  version INT NOT NULL PRIMARY KEY,
+  description VARCHAR(255) NOT NULL,
+  applied_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+	schemaVersionQuery  = `SELECT COALESCE(MAX(version), 0) FROM cw_snmp_schema_migrations`
+	recordMigrationStmt = `INSERT INTO cw_snmp_schema_migrations (version, description) VALUES (?, ?)`
+	// Held while migrating, so that two exporters do not migrate at once.
+	migrationLock = "snmp_exporter_migrate"
+)
+
+// checkSchema returns an error unless the database is at SchemaVersion.
+func (s *MySQLSource) checkSchema(ctx context.Context) error {
+	var version int
+	rows, err := s.query(ctx, schemaVersionQuery)
+	if err != nil {
+		return fmt.Errorf("Error reading the database schema version, run 'snmp_exporter db migrate' to create the schema: %s", err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		if err := rows.Scan(&version); err != nil {
+			return fmt.Errorf("Error reading the database schema version: %s", err)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("Error reading the database schema version: %s", err)
+	}
+	switch {
+	case version < SchemaVersion:
+		return fmt.Errorf("Database schema is at version %d, but version %d is required, run 'snmp_exporter db migrate'", version, SchemaVersion)
+	case version > SchemaVersion:
+		return fmt.Errorf("Database schema is at version %d, newer than the version %d this exporter supports", version, SchemaVersion)
+	}
+	return nil
+}
+
+// Migrate brings the database schema up to SchemaVersion, and returns the
+// version it was at before.
+func (s *MySQLSource) Migrate(ctx context.Context) (int, error) {
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("Error connecting to database: %s", err)
+	}
+	defer conn.Close()
+
+	var locked sql.NullInt64
+	if err := conn.QueryRowContext(ctx, "SELECT GET_LOCK(?, 60)", migrationLock).Scan(&locked); err != nil {
+		return 0, fmt.Errorf("Error taking the migration lock: %s", err)
+	}
+	if locked.Int64 != 1 {
+		return 0, fmt.Errorf("Timed out waiting for another migration to finish")
+	}
+	defer conn.ExecContext(context.Background(), "SELECT RELEASE_LOCK(?)", migrationLock)
+
+	if _, err := conn.ExecContext(ctx, createSchemaVersionTable); err != nil {
+		return 0, fmt.Errorf("Error creating the schema version table: %s", err)
+	}
+	var from int
+	if err := conn.QueryRowContext(ctx, schemaVersionQuery).Scan(&from); err != nil {
+		return 0, fmt.Errorf("Error reading the database schema version: %s", err)
+	}
+	if from > SchemaVersion {
+		return from, fmt.Errorf("Database schema is at version %d, newer than the version %d this exporter supports", from, SchemaVersion)
+	}
+	for version := from + 1; version <= SchemaVersion; version++ {
+		m := migrations[version-1]
+		// MySQL commits DDL statements implicitly, so a migration cannot be
+		// rolled back.
+		for _, stmt := range m.statements {
+			if _, err := conn.ExecContext(ctx, stmt); err != nil {
+				return from, fmt.Errorf("Error applying schema version %d (%s): %s", version, m.description, err)
+			}
+		}
+		if _, err := conn.ExecContext(ctx, recordMigrationStmt, version, m.description); err != nil {
+			return from, fmt.Errorf("Error recording schema version %d: %s", version, err)
+		}
+	}
+	return from, nil
+}
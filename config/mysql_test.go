@@ -0,0 +1,898 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMySQLLoad(t *testing.T) {
+	db := newFakeDB()
+	for _, module := range []string{"if_mib", "system", "empty"} {
+		db.insert("cw_hardware_module", fakeRow{"module": module, "name": module})
+	}
+	metric := func(module, name, oid, requestType string) int64 {
+		return db.insert("cw_snmp_custom_metrics", fakeRow{
+			"name": name, "oid": oid, "type": "gauge", "help": name, "request_type": requestType,
+			"module": module, "org_id": int64(0), "sys_id": int64(0), "cache_ttl_seconds": float64(0),
+		})
+	}
+	inOctets := metric("if_mib", "ifInOctets", "1.3.6.1.2.1.2.2.1.10", "walk")
+	db.insert("cw_snmp_custom_metric_indexes", fakeRow{
+		"metric_id": inOctets, "position": int64(0), "labelname": "ifIndex", "type": "gauge", "fixed_size": int64(0),
+	})
+	db.insert("cw_snmp_custom_metric_lookups", fakeRow{
+		"metric_id": inOctets, "position": int64(0), "labels": "ifIndex, ", "labelname": "ifDescr",
+		"oid": "1.3.6.1.2.1.2.2.1.2", "type": "DisplayString", "cache_ttl_seconds": float64(300),
+	})
+	db.insert("cw_snmp_custom_metric_regex_extracts", fakeRow{
+		"metric_id": inOctets, "position": int64(0), "name": "", "regex": ".*", "value": nil,
+	})
+	metric("system", "sysUpTime", "1.3.6.1.2.1.1.3.0", "get")
+	metric("system", "sysORLastChange", "1.3.6.1.2.1.1.8", "trap")
+	metric("removed", "sysName", "1.3.6.1.2.1.1.5", "walk")
+	// A profile that only sets some of the walk parameters.
+	profile := db.insert("cw_snmp_credential_profiles", fakeRow{"name": "v1", "version": int64(1), "retries": int64(5)})
+	db.insert("cw_snmp_module_profiles", fakeRow{"module": "system", "profile_id": profile})
+
+	cfg, err := db.source(nil).Load()
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+
+	re, err := NewRegexp(".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1 := DefaultWalkParams
+	v1.Version = 1
+	v1.Retries = 5
+	expected := Config{
+		"if_mib": {
+			Walk: []string{"1.3.6.1.2.1.2.2.1.10", "1.3.6.1.2.1.2.2.1.2"},
+			Metrics: []*Metric{{
+				Name:    "ifInOctets",
+				Oid:     "1.3.6.1.2.1.2.2.1.10",
+				Type:    "gauge",
+				Help:    "ifInOctets",
+				Indexes: []*Index{{Labelname: "ifIndex", Type: "gauge"}},
+				Lookups: []*Lookup{{
+					Labels:    []string{"ifIndex"},
+					Labelname: "ifDescr",
+					Oid:       "1.3.6.1.2.1.2.2.1.2",
+					Type:      "DisplayString",
+					CacheTTL:  5 * time.Minute,
+				}},
+				RegexpExtracts: map[string][]RegexpExtract{"": {{Value: "$1", Regex: re}}},
+			}},
+			WalkParams: DefaultWalkParams,
+		},
+		"system": {
+			Get: []string{"1.3.6.1.2.1.1.3.0"},
+			Metrics: []*Metric{
+				{Name: "sysUpTime", Oid: "1.3.6.1.2.1.1.3.0", Type: "gauge", Help: "sysUpTime"},
+				{Name: "sysORLastChange", Oid: "1.3.6.1.2.1.1.8", Type: "gauge", Help: "sysORLastChange"},
+			},
+			WalkParams: v1,
+			setParams:  map[string]bool{"version": true, "retries": true},
+		},
+		"empty": {WalkParams: DefaultWalkParams},
+	}
+	for name, want := range expected {
+		got, ok := (*cfg)[name]
+		if !ok {
+			t.Errorf("Module %s missing", name)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			gotYAML, _ := yaml.Marshal(got)
+			wantYAML, _ := yaml.Marshal(want)
+			t.Errorf("Module %s loaded as:\n%s\nExpected:\n%s", name, gotYAML, wantYAML)
+		}
+	}
+	if len(*cfg) != len(expected) {
+		t.Errorf("Expected %d modules, got %d", len(expected), len(*cfg))
+	}
+}
+
+func TestMySQLLoadProfiles(t *testing.T) {
+	key, err := ParseSecretKey("MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	community, err := key.Encrypt("s3cr3t")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, c := range []struct {
+		name    string
+		profile fakeRow
+		key     *SecretKey
+		check   func(WalkParams) bool
+		err     string
+	}{
+		{
+			name:    "encrypted community",
+			profile: fakeRow{"community": community},
+			key:     key,
+			check:   func(wp WalkParams) bool { return wp.Auth.Community == "s3cr3t" },
+		},
+		{
+			name:    "empty community",
+			profile: fakeRow{"community": ""},
+			check:   func(wp WalkParams) bool { return wp.Auth.Community == "" },
+		},
+		{
+			name:    "NULL community",
+			profile: fakeRow{"community": nil, "timeout_seconds": 2.5},
+			check: func(wp WalkParams) bool {
+				return wp.Auth.Community == "public" && wp.Timeout == 2500*time.Millisecond
+			},
+		},
+		{
+			name:    "no secret key",
+			profile: fakeRow{"community": community},
+			err:     "no secret key is configured",
+		},
+		{
+			name:    "invalid",
+			profile: fakeRow{"version": int64(3), "security_level": "authNoPriv", "username": "user"},
+			err:     "Invalid credential profile for module m",
+		},
+	} {
+		db := newFakeDB()
+		db.insert("cw_hardware_module", fakeRow{"module": "m"})
+		id := db.insert("cw_snmp_credential_profiles", c.profile)
+		db.insert("cw_snmp_module_profiles", fakeRow{"module": "m", "profile_id": id})
+
+		cfg, err := db.source(c.key).Load()
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%s: Expected error containing %q, got: %v", c.name, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: Error loading config: %v", c.name, err)
+			continue
+		}
+		if wp := (*cfg)["m"].WalkParams; !c.check(wp) {
+			t.Errorf("%s: Unexpected walk parameters: %+v", c.name, wp)
+		}
+	}
+}
+
+// roundTripConfig is imported into the database and loaded back.
+const roundTripConfig = `
+if_mib:
+  walk: [1.3.6.1.2.1.2.2.1.10, 1.3.6.1.2.1.31.1.1.1.1]
+  get: [1.3.6.1.2.1.1.3.0]
+  version: 3
+  timeout: 5s
+  auth:
+    security_level: authNoPriv
+    username: user
+    password: pass
+  metrics:
+  - name: sysUpTime
+    oid: 1.3.6.1.2.1.1.3
+    type: gauge
+    help: The time since the agent started.
+  - name: ifInOctets
+    oid: 1.3.6.1.2.1.2.2.1.10
+    type: counter
+    help: The octets received on the interface.
+    indexes:
+    - labelname: ifIndex
+      type: gauge
+    lookups:
+    - labels: [ifIndex]
+      labelname: ifName
+      oid: 1.3.6.1.2.1.31.1.1.1.1
+      type: DisplayString
+      cache_ttl: 1h
+    cache_ttl: 10m
+  - name: ifInOctets
+    oid: 1.3.6.1.2.1.2.2.1.10
+    type: counter
+    help: The octets received on the interface, for org 1.
+    org_id: 1
+    regex_extracts:
+      Status:
+      - regex: (.*)
+        value: $1
+if_mib_v2:
+  extends: [if_mib]
+  version: 2
+  auth:
+    community: public
+system:
+  walk: [1.3.6.1.2.1.1]
+  metrics:
+  - name: sysName
+    oid: 1.3.6.1.2.1.1.5
+    type: DisplayString
+    help: The name of the system.
+`
+
+func TestMySQLImportRoundTrip(t *testing.T) {
+	content := []byte(roundTripConfig)
+	key, err := ParseSecretKey("MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected, err := parse(content)
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+
+	db := newFakeDB()
+	source := db.source(key)
+	// The second import updates what the first inserted.
+	for i := 0; i < 2; i++ {
+		cfg, err := unmarshal(content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := source.Import(*cfg, true); err != nil {
+			t.Fatalf("Error importing config: %v", err)
+		}
+		loaded, err := source.Load()
+		if err != nil {
+			t.Fatalf("Error loading imported config: %v", err)
+		}
+		if !reflect.DeepEqual(*loaded, *expected) {
+			gotYAML, _ := yaml.Marshal(loaded)
+			wantYAML, _ := yaml.Marshal(expected)
+			t.Errorf("Import %d loaded back as:\n%s\nExpected:\n%s", i+1, gotYAML, wantYAML)
+		}
+	}
+	// Only the walk parameters a module sets are stored, even at their default.
+	found := false
+	for _, profile := range db.tables["cw_snmp_credential_profiles"] {
+		if profile["name"] != "if_mib_v2" {
+			continue
+		}
+		found = true
+		if profile["version"] != int64(2) || profile["community"] == nil || profile["retries"] != nil || profile["username"] != nil {
+			t.Errorf("Unexpected credential profile for module if_mib_v2: %v", profile)
+		}
+	}
+	if !found {
+		t.Error("No credential profile imported for module if_mib_v2")
+	}
+	if n := len(db.tables["cw_snmp_custom_metrics"]); n != 4 {
+		t.Errorf("Expected 4 metrics in the database, got %d", n)
+	}
+	for _, metric := range db.tables["cw_snmp_custom_metrics"] {
+		want := "walk"
+		if metric["name"] == "sysUpTime" {
+			want = "get"
+		}
+		if metric["request_type"] != want {
+			t.Errorf("Metric %s imported with request_type %v, want %s", metric["name"], metric["request_type"], want)
+		}
+	}
+}
+
+func TestMySQLExportRoundTrip(t *testing.T) {
+	key, err := ParseSecretKey("MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SNMP_EXPORTER_TEST_COMMUNITY", "envsecret")
+	defer os.Unsetenv("SNMP_EXPORTER_TEST_COMMUNITY")
+	cfg, err := unmarshal([]byte(roundTripConfig + `
+system_v2:
+  extends: [system]
+  version: 2
+  retries: 0
+  auth:
+    community: ${SNMP_EXPORTER_TEST_COMMUNITY}
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	export := func(source *MySQLSource, showSecrets bool) []byte {
+		cfg, err := source.Export()
+		if err != nil {
+			t.Fatalf("Error exporting config: %v", err)
+		}
+		DoNotHideSecrets = showSecrets
+		defer func() { DoNotHideSecrets = false }()
+		content, err := yaml.Marshal(cfg)
+		if err != nil {
+			t.Fatalf("Error marshaling config: %v", err)
+		}
+		return content
+	}
+
+	first := newFakeDB().source(key)
+	if err := first.Import(*cfg, false); err != nil {
+		t.Fatalf("Error importing config: %v", err)
+	}
+	exported := export(first, true)
+	// Modules keep what they extend rather than what they inherit, and the
+	// references of their secrets.
+	reread, err := unmarshal(exported)
+	if err != nil {
+		t.Fatalf("Error reading exported config: %v\n%s", err, exported)
+	}
+	if m := (*reread)["if_mib_v2"]; len(m.Metrics) != 0 || len(m.Walk) != 0 || !reflect.DeepEqual(m.Extends, []string{"if_mib"}) {
+		t.Errorf("Expected if_mib_v2 to only extend if_mib, got:\n%s", exported)
+	}
+	if m := (*reread)["system_v2"]; m.WalkParams.Auth.Community != "${SNMP_EXPORTER_TEST_COMMUNITY}" || !m.setParams["retries"] || m.setParams["timeout"] {
+		t.Errorf("Expected system_v2 to keep its reference and set walk parameters, got:\n%s", exported)
+	}
+
+	second := newFakeDB().source(key)
+	if err := second.Import(*reread, false); err != nil {
+		t.Fatalf("Error importing exported config: %v", err)
+	}
+	if again := export(second, true); string(again) != string(exported) {
+		t.Errorf("Config exported again as:\n%s\nExpected:\n%s", again, exported)
+	}
+	loaded, err := second.Load()
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	expected, err := first.Load()
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	if !reflect.DeepEqual(loaded, expected) {
+		t.Error("Expected the exported config to load the same as the original")
+	}
+
+	// Hidden secrets are not imported as the credentials.
+	hidden, err := unmarshal(export(first, false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := newFakeDB().source(key).Import(*hidden, false); err == nil || !strings.Contains(err.Error(), hiddenSecret) {
+		t.Errorf("Expected an error importing hidden secrets, got: %v", err)
+	}
+}
+
+func TestMySQLImportSecretReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	privPasswordFile := filepath.Join(dir, "priv_password")
+	if err := ioutil.WriteFile(privPasswordFile, []byte("filesecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SNMP_EXPORTER_TEST_PASSWORD", "envsecret")
+	defer os.Unsetenv("SNMP_EXPORTER_TEST_PASSWORD")
+	configFile := filepath.Join(dir, "snmp.yml")
+	content := `
+module:
+  version: 3
+  auth:
+    security_level: authPriv
+    username: user
+    password: ${SNMP_EXPORTER_TEST_PASSWORD}
+    priv_password_file: ` + privPasswordFile + "\n"
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := ParseSecretKey("MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := ReadRawFile(configFile)
+	if err != nil {
+		t.Fatalf("Error reading config: %v", err)
+	}
+	db := newFakeDB()
+	source := db.source(key)
+	if err := source.Import(*cfg, false); err != nil {
+		t.Fatalf("Error importing config: %v", err)
+	}
+
+	// The references are stored rather than what they resolve to.
+	profile := db.tables["cw_snmp_credential_profiles"][0]
+	password, err := key.Decrypt(profile["password"].(string))
+	if err != nil {
+		t.Fatalf("Error decrypting password: %v", err)
+	}
+	if password != "${SNMP_EXPORTER_TEST_PASSWORD}" {
+		t.Errorf("Expected the reference to the environment variable to be stored, got %q", password)
+	}
+	if profile["priv_password"] != nil || profile["priv_password_file"] != privPasswordFile {
+		t.Errorf("Expected only the priv password file to be stored, got %v and %v", profile["priv_password"], profile["priv_password_file"])
+	}
+
+	// They are resolved on load.
+	loaded, err := source.Load()
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	auth := (*loaded)["module"].WalkParams.Auth
+	if auth.Password != "envsecret" || auth.PrivPassword != "filesecret" {
+		t.Errorf("Secrets not resolved on load, got password %q and priv password %q", auth.Password, auth.PrivPassword)
+	}
+}
+
+func TestMySQLQueriesMatchSchema(t *testing.T) {
+	for _, query := range []string{
+		loadModulesQuery, loadWalkParamsQuery, loadExtendsQuery, loadModuleOidsQuery,
+		loadIndexesQuery, loadLookupsQuery, loadRegexpExtractsQuery, loadPollTargetsQuery,
+		schemaVersionQuery, recordMigrationStmt,
+	} {
+		if err := checkSchema(query); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, query := range []string{
+		`SELECT module, parnet FROM cw_snmp_module_extends`,
+		`SELECT m.module, c.nmae FROM cw_hardware_module m JOIN cw_snmp_custom_metrics c ON c.module = m.module`,
+		`SELECT id FROM cw_snmp_custom_metric WHERE module = ?`,
+	} {
+		if err := checkSchema(query); err == nil {
+			t.Errorf("Expected query %q not to match the schema", query)
+		}
+	}
+}
+
+// TestMySQLServer imports a config into a real MySQL database and loads it
+// back, running the statements of the source as they are, joins included.
+// It needs the DSN of an empty database in SNMP_EXPORTER_TEST_MYSQL_DSN.
+func TestMySQLServer(t *testing.T) {
+	dsn := os.Getenv("SNMP_EXPORTER_TEST_MYSQL_DSN")
+	if dsn == "" {
+		t.Skip("SNMP_EXPORTER_TEST_MYSQL_DSN is not set")
+	}
+	source, err := NewMySQLSource(MySQLConfig{
+		DSN:       dsn,
+		Timeout:   10 * time.Second,
+		SecretKey: "MDEyMzQ1Njc4OTAxMjM0NTY3ODkwMTIzNDU2Nzg5MDE=",
+	})
+	if err != nil {
+		t.Fatalf("Error setting up database: %v", err)
+	}
+	if _, err := source.Migrate(context.Background()); err != nil {
+		t.Fatalf("Error migrating database: %v", err)
+	}
+	expected, err := parse([]byte(roundTripConfig))
+	if err != nil {
+		t.Fatalf("Error parsing config: %v", err)
+	}
+	cfg, err := unmarshal([]byte(roundTripConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := source.Import(*cfg, true); err != nil {
+		t.Fatalf("Error importing config: %v", err)
+	}
+	loaded, err := source.Load()
+	if err != nil {
+		t.Fatalf("Error loading imported config: %v", err)
+	}
+	if !reflect.DeepEqual(*loaded, *expected) {
+		gotYAML, _ := yaml.Marshal(loaded)
+		wantYAML, _ := yaml.Marshal(expected)
+		t.Errorf("Config loaded back as:\n%s\nExpected:\n%s", gotYAML, wantYAML)
+	}
+}
+
+// fakeDB is an in-memory database for MySQLSource. It runs the simple
+// statements of the source, a SELECT, INSERT, UPDATE or DELETE on one table
+// with conditions of the form "column = ?". Queries that join tables are
+// answered by the functions in joins, which pair up the rows of the tables
+// by their alias in the query, and the columns the query selects are taken
+// from those. Every table and column a statement names must be in the schema
+// the migrations create.
+type fakeDB struct {
+	mtx    sync.Mutex
+	tables map[string][]fakeRow
+	ids    map[string]int64
+	joins  map[string]func(db *fakeDB) []fakeJoinRow
+}
+
+type fakeRow map[string]driver.Value
+
+// fakeJoinRow is a row of a join, with the row of each table by its alias.
+type fakeJoinRow map[string]fakeRow
+
+func newFakeDB() *fakeDB {
+	return &fakeDB{
+		tables: map[string][]fakeRow{},
+		ids:    map[string]int64{},
+		joins: map[string]func(db *fakeDB) []fakeJoinRow{
+			loadModulesQuery:    fakeLoadModules,
+			loadWalkParamsQuery: fakeLoadWalkParams,
+		},
+	}
+}
+
+// insert adds a row, with the next id of the table unless it has one.
+func (db *fakeDB) insert(table string, row fakeRow) int64 {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	return db.insertLocked(table, row)
+}
+
+func (db *fakeDB) insertLocked(table string, row fakeRow) int64 {
+	if id, ok := row["id"]; ok {
+		if id.(int64) > db.ids[table] {
+			db.ids[table] = id.(int64)
+		}
+	} else {
+		db.ids[table]++
+		row["id"] = db.ids[table]
+	}
+	db.tables[table] = append(db.tables[table], row)
+	return row["id"].(int64)
+}
+
+// source returns a MySQLSource reading from the fake database.
+func (db *fakeDB) source(key *SecretKey) *MySQLSource {
+	return &MySQLSource{
+		db:        sql.OpenDB(db),
+		name:      "fake",
+		secretKey: key,
+		stmts:     map[string]*sql.Stmt{},
+	}
+}
+
+var (
+	fakeSelect     = regexp.MustCompile(`^SELECT (.+?) FROM (\w+)(?: WHERE (.+?))?(?: ORDER BY (.+))?$`)
+	fakeSelectList = regexp.MustCompile(`^SELECT (.+?) FROM `)
+	fakeInsert     = regexp.MustCompile(`^INSERT INTO (\w+) \((.+?)\) VALUES \((.+?)\)( ON DUPLICATE KEY UPDATE .+)?$`)
+	fakeUpdate     = regexp.MustCompile(`^UPDATE (\w+) SET (.+) WHERE (.+)$`)
+	fakeDelete     = regexp.MustCompile(`^DELETE FROM (\w+) WHERE (.+)$`)
+
+	// Tables a statement names, with their alias if any. Keywords are in
+	// upper case, tables, aliases and columns in lower case.
+	fakeTableNames = regexp.MustCompile(`(?:^UPDATE|\bFROM|\bJOIN|\bINTO) (\w+)(?: ([a-z]\w*))?`)
+	// Names in a statement, qualified by an alias or not. Those followed by
+	// a parenthesis are functions, or the table of an INSERT.
+	fakeNames = regexp.MustCompile(`\b(?:([a-z]\w*)\.)?([a-z]\w*)\b( ?\()?`)
+
+	// The columns of each table of the schema.
+	fakeSchema = schemaColumns()
+)
+
+// schemaColumns returns the columns of each table the migrations create.
+func schemaColumns() map[string]map[string]bool {
+	create := regexp.MustCompile(`(?s)^\s*CREATE TABLE IF NOT EXISTS (\w+) \((.*)\)\s*$`)
+	alter := regexp.MustCompile(`^\s*ALTER TABLE (\w+)`)
+	addColumn := regexp.MustCompile(`ADD COLUMN (\w+)`)
+	statements := []string{createSchemaVersionTable}
+	for _, m := range migrations {
+		statements = append(statements, m.statements...)
+	}
+	tables := map[string]map[string]bool{}
+	for _, stmt := range statements {
+		if m := create.FindStringSubmatch(stmt); m != nil {
+			columns := map[string]bool{}
+			for _, line := range strings.Split(m[2], "\n") {
+				fields := strings.Fields(line)
+				if len(fields) == 0 || fields[0] == "PRIMARY" || fields[0] == "KEY" {
+					continue
+				}
+				columns[fields[0]] = true
+			}
+			tables[m[1]] = columns
+		} else if m := alter.FindStringSubmatch(stmt); m != nil {
+			for _, column := range addColumn.FindAllStringSubmatch(stmt, -1) {
+				tables[m[1]][column[1]] = true
+			}
+		}
+	}
+	return tables
+}
+
+// checkSchema returns an error unless the tables and columns the statement
+// names are in the schema.
+func checkSchema(query string) error {
+	query = strings.Join(strings.Fields(query), " ")
+	aliases := map[string]string{}
+	for _, m := range fakeTableNames.FindAllStringSubmatch(query, -1) {
+		if fakeSchema[m[1]] == nil {
+			return fmt.Errorf("no table %s in the schema for %q", m[1], query)
+		}
+		aliases[m[1]] = m[1]
+		if m[2] != "" {
+			aliases[m[2]] = m[1]
+		}
+	}
+	for _, m := range fakeNames.FindAllStringSubmatch(query, -1) {
+		alias, name := m[1], m[2]
+		if alias == "" && (m[3] != "" || aliases[name] != "") {
+			continue
+		}
+		if alias != "" {
+			if table := aliases[alias]; table == "" || !fakeSchema[table][name] {
+				return fmt.Errorf("no column %s.%s in the schema for %q", alias, name, query)
+			}
+			continue
+		}
+		found := false
+		for _, table := range aliases {
+			found = found || fakeSchema[table][name]
+		}
+		if !found {
+			return fmt.Errorf("no column %s in the schema for %q", name, query)
+		}
+	}
+	return nil
+}
+
+func (db *fakeDB) query(query string, args []driver.Value) (*fakeRows, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if err := checkSchema(query); err != nil {
+		return nil, err
+	}
+	normalized := strings.Join(strings.Fields(query), " ")
+	if query == schemaVersionQuery {
+		return &fakeRows{columns: []string{"version"}, values: [][]driver.Value{{int64(SchemaVersion)}}}, nil
+	}
+	if join, ok := db.joins[query]; ok {
+		return project(fakeSelectList.FindStringSubmatch(normalized)[1], join(db))
+	}
+	m := fakeSelect.FindStringSubmatch(normalized)
+	if m == nil {
+		return nil, fmt.Errorf("fake database cannot run %q", query)
+	}
+	rows := &fakeRows{columns: strings.Split(m[1], ", ")}
+	matched, err := db.where(m[2], m[3], args)
+	if err != nil {
+		return nil, err
+	}
+	if m[4] != "" {
+		sortRows(matched, strings.Split(m[4], ", ")...)
+	}
+	for _, row := range matched {
+		values := make([]driver.Value, len(rows.columns))
+		for i, column := range rows.columns {
+			values[i] = row[column]
+		}
+		rows.values = append(rows.values, values)
+	}
+	return rows, nil
+}
+
+// project returns the selected columns, such as "m.module, c.id", of the
+// rows of a join.
+func project(selected string, joined []fakeJoinRow) (*fakeRows, error) {
+	rows := &fakeRows{columns: strings.Split(selected, ", ")}
+	for _, j := range joined {
+		values := make([]driver.Value, len(rows.columns))
+		for i, column := range rows.columns {
+			parts := strings.SplitN(column, ".", 2)
+			row, ok := j[parts[0]]
+			if len(parts) != 2 || !ok {
+				return nil, fmt.Errorf("fake join has no table for column %s", column)
+			}
+			values[i] = row[parts[1]]
+		}
+		rows.values = append(rows.values, values)
+	}
+	return rows, nil
+}
+
+func (db *fakeDB) exec(query string, args []driver.Value) (driver.Result, error) {
+	db.mtx.Lock()
+	defer db.mtx.Unlock()
+	if err := checkSchema(query); err != nil {
+		return nil, err
+	}
+	query = strings.Join(strings.Fields(query), " ")
+	if m := fakeInsert.FindStringSubmatch(query); m != nil {
+		row := fakeRow{}
+		for i, column := range strings.Split(m[2], ", ") {
+			row[column] = args[i]
+		}
+		if m[4] != "" {
+			// Upsert on the first column.
+			first := strings.Split(m[2], ", ")[0]
+			for _, old := range db.tables[m[1]] {
+				if old[first] == row[first] {
+					for column, value := range row {
+						old[column] = value
+					}
+					return driver.RowsAffected(1), nil
+				}
+			}
+		}
+		return fakeResult(db.insertLocked(m[1], row)), nil
+	}
+	if m := fakeUpdate.FindStringSubmatch(query); m != nil {
+		set := strings.Split(m[2], ", ")
+		matched, err := db.where(m[1], m[3], args[len(set):])
+		if err != nil {
+			return nil, err
+		}
+		for _, row := range matched {
+			for i, assignment := range set {
+				row[strings.TrimSuffix(assignment, " = ?")] = args[i]
+			}
+		}
+		return driver.RowsAffected(1), nil
+	}
+	if m := fakeDelete.FindStringSubmatch(query); m != nil {
+		kept := []fakeRow{}
+		for _, row := range db.tables[m[1]] {
+			ok, err := matches(row, m[2], args)
+			if err != nil {
+				return nil, err
+			}
+			if !ok {
+				kept = append(kept, row)
+			}
+		}
+		db.tables[m[1]] = kept
+		return driver.RowsAffected(1), nil
+	}
+	return nil, fmt.Errorf("fake database cannot run %q", query)
+}
+
+// where returns the rows of the table that satisfy the conditions.
+func (db *fakeDB) where(table, conditions string, args []driver.Value) ([]fakeRow, error) {
+	var matched []fakeRow
+	for _, row := range db.tables[table] {
+		ok, err := matches(row, conditions, args)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+	return matched, nil
+}
+
+// matches returns whether the row satisfies conditions such as
+// "a = ? AND b = ?" with the arguments.
+func matches(row fakeRow, conditions string, args []driver.Value) (bool, error) {
+	if conditions == "" {
+		return true, nil
+	}
+	for i, condition := range strings.Split(conditions, " AND ") {
+		if !strings.HasSuffix(condition, " = ?") || i >= len(args) {
+			return false, fmt.Errorf("fake database cannot match %q", conditions)
+		}
+		if !reflect.DeepEqual(row[strings.TrimSuffix(condition, " = ?")], args[i]) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+func sortRows(rows []fakeRow, columns ...string) {
+	sort.SliceStable(rows, func(i, j int) bool {
+		for _, column := range columns {
+			a, b := fmt.Sprint(rows[i][column]), fmt.Sprint(rows[j][column])
+			if x, ok := rows[i][column].(int64); ok {
+				a, b = fmt.Sprintf("%020d", x), fmt.Sprintf("%020d", rows[j][column])
+			}
+			if a != b {
+				return a < b
+			}
+		}
+		return false
+	})
+}
+
+// fakeLoadModules joins each module with its metrics, ordered by module and
+// metric, and modules without metrics with NULL columns.
+func fakeLoadModules(db *fakeDB) []fakeJoinRow {
+	modules := append([]fakeRow(nil), db.tables["cw_hardware_module"]...)
+	sortRows(modules, "module")
+	var rows []fakeJoinRow
+	for _, m := range modules {
+		var metrics []fakeRow
+		for _, c := range db.tables["cw_snmp_custom_metrics"] {
+			if c["module"] == m["module"] {
+				metrics = append(metrics, c)
+			}
+		}
+		if len(metrics) == 0 {
+			metrics = []fakeRow{{}}
+		}
+		sortRows(metrics, "id")
+		for _, c := range metrics {
+			rows = append(rows, fakeJoinRow{"m": m, "c": c})
+		}
+	}
+	return rows
+}
+
+// fakeLoadWalkParams joins each module with the profile assigned to it.
+func fakeLoadWalkParams(db *fakeDB) []fakeJoinRow {
+	var rows []fakeJoinRow
+	for _, mp := range db.tables["cw_snmp_module_profiles"] {
+		for _, p := range db.tables["cw_snmp_credential_profiles"] {
+			if p["id"] == mp["profile_id"] {
+				rows = append(rows, fakeJoinRow{"mp": mp, "p": p})
+			}
+		}
+	}
+	return rows
+}
+
+// The database/sql driver of fakeDB.
+
+func (db *fakeDB) Connect(context.Context) (driver.Conn, error) { return fakeConn{db}, nil }
+func (db *fakeDB) Driver() driver.Driver                        { return nil }
+
+type fakeConn struct{ db *fakeDB }
+
+func (c fakeConn) Prepare(query string) (driver.Stmt, error) { return fakeStmt{c.db, query}, nil }
+func (c fakeConn) Close() error                              { return nil }
+func (c fakeConn) Begin() (driver.Tx, error)                 { return fakeTx{}, nil }
+
+// Transactions are not isolated, nor rolled back.
+type fakeTx struct{}
+
+func (fakeTx) Commit() error   { return nil }
+func (fakeTx) Rollback() error { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s fakeStmt) Close() error  { return nil }
+func (s fakeStmt) NumInput() int { return -1 }
+func (s fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.db.exec(s.query, args)
+}
+func (s fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.db.query(s.query, args)
+}
+
+type fakeResult int64
+
+func (r fakeResult) LastInsertId() (int64, error) { return int64(r), nil }
+func (r fakeResult) RowsAffected() (int64, error) { return 1, nil }
+
+type fakeRows struct {
+	columns []string
+	values  [][]driver.Value
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,94 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// SecretKey encrypts the secrets stored in the database with AES-256-GCM.
+// Encrypted values are the base64 encoding of the nonce followed by the
+// sealed secret.
+type SecretKey struct {
+	aead cipher.AEAD
+}
+
+// ParseSecretKey parses a base64 encoded 32 byte key.
+func ParseSecretKey(s string) (*SecretKey, error) {
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(s))
+	if err != nil {
+		return nil, fmt.Errorf("Secret key is not valid base64: %s", err)
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("Secret key must be 32 bytes, got %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &SecretKey{aead: aead}, nil
+}
+
+// LoadSecretKeyFile reads a key in the format of ParseSecretKey from a file.
+func LoadSecretKeyFile(filename string) (*SecretKey, error) {
+	content, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	return ParseSecretKey(string(content))
+}
+
+// Encrypt seals a secret. The empty secret stays empty.
+func (k *SecretKey) Encrypt(s Secret) (string, error) {
+	if s == "" {
+		return "", nil
+	}
+	nonce := make([]byte, k.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := k.aead.Seal(nonce, nonce, []byte(s), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// Decrypt opens a secret sealed by Encrypt.
+func (k *SecretKey) Decrypt(s string) (Secret, error) {
+	if s == "" {
+		return "", nil
+	}
+	sealed, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("Encrypted secret is not valid base64: %s", err)
+	}
+	nonceSize := k.aead.NonceSize()
+	if len(sealed) < nonceSize {
+		return "", fmt.Errorf("Encrypted secret is too short")
+	}
+	plain, err := k.aead.Open(nil, sealed[:nonceSize], sealed[nonceSize:], nil)
+	if err != nil {
+		return "", fmt.Errorf("Error decrypting secret: %s", err)
+	}
+	return Secret(plain), nil
+}
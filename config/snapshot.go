@@ -0,0 +1,82 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// WriteSnapshot saves the configuration, secrets included, to a file that
+// LoadSnapshot can read back. The file is replaced atomically and is only
+// readable by its owner. Modules are saved as resolved, without what they
+// extend, as the walk parameters they set themselves are not saved.
+//
+// As secrets are revealed through DoNotHideSecrets, the caller must make
+// sure nothing else marshals a Config at the same time.
+func WriteSnapshot(c Config, filename string) error {
+	resolved := make(Config, len(c))
+	for name, m := range c {
+		module := *m
+		module.Extends = nil
+		resolved[name] = &module
+	}
+	DoNotHideSecrets = true
+	content, err := yaml.Marshal(resolved)
+	DoNotHideSecrets = false
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), filepath.Base(filename)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), filename)
+}
+
+// LoadSnapshot reads a configuration saved by WriteSnapshot, along with the
+// time it was saved.
+func LoadSnapshot(filename string) (*Config, time.Time, error) {
+	info, err := os.Stat(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	c, err := LoadFile(filename)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	return c, info.ModTime(), nil
+}
+
+// TouchSnapshot marks a snapshot as saved now, for when the source still
+// provides the same configuration.
+func TouchSnapshot(filename string) error {
+	now := time.Now()
+	return os.Chtimes(filename, now, now)
+}
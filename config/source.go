@@ -0,0 +1,187 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Source is somewhere a Config can be loaded from.
+type Source interface {
+	// Load reads and parses the whole configuration.
+	Load() (*Config, error)
+	// String describes the source for log messages.
+	String() string
+}
+
+// PartialError is returned along with a Config by sources that could only
+// load part of it.
+type PartialError struct {
+	Errors []error
+}
+
+func (e *PartialError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// FileSource loads the configuration from a YAML file, or from all the
+// *.yml and *.yaml files of a directory or the files matching a glob.
+//
+// With several files, each is loaded on its own. A file that fails to load
+// keeps the modules it had when it last loaded, if any, while the others
+// are used as they are now. A module defined in two files is only taken from
+// the first, and modules that cannot be resolved, such as those extending an
+// unknown module, are left out. Such failures are returned as a PartialError.
+type FileSource struct {
+	Path string
+
+	mtx sync.Mutex
+	// The modules of each file as last loaded without errors.
+	last map[string]Config
+}
+
+func (s *FileSource) Load() (*Config, error) {
+	files, multiple, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	if !multiple {
+		return LoadFile(s.Path)
+	}
+
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if s.last == nil {
+		s.last = map[string]Config{}
+	}
+	cfg := Config{}
+	origin := map[string]string{}
+	partial := &PartialError{}
+	for _, file := range files {
+		fileCfg, err := ReadFile(file)
+		if err != nil {
+			partial.Errors = append(partial.Errors, fmt.Errorf("Error loading %s: %s", file, err))
+			fileCfg = &Config{}
+			if last, ok := s.last[file]; ok {
+				fileCfg = &last
+			}
+		} else {
+			s.last[file] = *fileCfg
+		}
+		for name, module := range *fileCfg {
+			if first, ok := origin[name]; ok {
+				partial.Errors = append(partial.Errors, fmt.Errorf("Module %s of %s is already defined in %s", name, file, first))
+				continue
+			}
+			origin[name] = file
+			cfg[name] = module
+		}
+	}
+	for file := range s.last {
+		if !containsString(files, file) {
+			delete(s.last, file)
+		}
+	}
+	errs := cfg.resolveEach()
+	names := make([]string, 0, len(errs))
+	for name := range errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		partial.Errors = append(partial.Errors, fmt.Errorf("Error loading %s: %s", origin[name], errs[name]))
+	}
+	if len(partial.Errors) > 0 {
+		return &cfg, partial
+	}
+	return &cfg, nil
+}
+
+// files returns the files the configuration is in, and whether Path names
+// a directory or glob rather than a single file.
+func (s *FileSource) files() ([]string, bool, error) {
+	if strings.ContainsAny(s.Path, "*?[") {
+		files, err := filepath.Glob(s.Path)
+		if err != nil {
+			return nil, true, err
+		}
+		if len(files) == 0 {
+			return nil, true, fmt.Errorf("No config files match %s", s.Path)
+		}
+		sort.Strings(files)
+		return files, true, nil
+	}
+	info, err := os.Stat(s.Path)
+	if err != nil || !info.IsDir() {
+		return []string{s.Path}, false, nil
+	}
+	entries, err := ioutil.ReadDir(s.Path)
+	if err != nil {
+		return nil, true, err
+	}
+	var files []string
+	for _, entry := range entries {
+		ext := filepath.Ext(entry.Name())
+		if !entry.IsDir() && (ext == ".yml" || ext == ".yaml") {
+			files = append(files, filepath.Join(s.Path, entry.Name()))
+		}
+	}
+	if len(files) == 0 {
+		return nil, true, fmt.Errorf("No config files in directory %s", s.Path)
+	}
+	return files, true, nil
+}
+
+func (s *FileSource) String() string {
+	return fmt.Sprintf("file %s", s.Path)
+}
+
+// HTTPSource fetches the YAML configuration from a remote URL.
+type HTTPSource struct {
+	URL     string
+	Timeout time.Duration
+}
+
+func (s *HTTPSource) Load() (*Config, error) {
+	client := &http.Client{Timeout: s.Timeout}
+	resp, err := client.Get(s.URL)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Unexpected status %q fetching %s", resp.Status, s.URL)
+	}
+	content, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	return parse(content)
+}
+
+func (s *HTTPSource) String() string {
+	return fmt.Sprintf("url %s", s.URL)
+}
@@ -0,0 +1,128 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"time"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+// PollTarget is a target to scrape in the background with a module, on
+// behalf of a tenant if OrgID is set.
+type PollTarget struct {
+	Target string `yaml:"target"`
+	// A module, or several separated by commas as in scrapes.
+	Module string `yaml:"module"`
+	OrgID  int    `yaml:"org_id,omitempty"`
+	SysID  int    `yaml:"sys_id,omitempty"`
+	// How often to poll the target, the default interval if 0.
+	Interval time.Duration `yaml:"interval,omitempty"`
+}
+
+// Validate checks that the target can be polled.
+func (t PollTarget) Validate() error {
+	switch {
+	case t.Target == "":
+		return fmt.Errorf("Target to poll is missing")
+	case t.Module == "":
+		return fmt.Errorf("Module to poll target %s with is missing", t.Target)
+	case t.SysID != 0 && t.OrgID == 0:
+		return fmt.Errorf("Sys of target %s requires an org", t.Target)
+	case t.Interval < 0:
+		return fmt.Errorf("Interval of target %s must not be negative. Got: %s", t.Target, t.Interval)
+	}
+	return nil
+}
+
+// TargetSource is somewhere the targets to poll can be loaded from.
+type TargetSource interface {
+	// LoadTargets reads all the targets to poll.
+	LoadTargets() ([]PollTarget, error)
+	// String describes the source for log messages.
+	String() string
+}
+
+// TargetFile loads the targets to poll from a YAML list.
+type TargetFile struct {
+	Path string
+}
+
+func (f *TargetFile) LoadTargets() ([]PollTarget, error) {
+	content, err := ioutil.ReadFile(f.Path)
+	if err != nil {
+		return nil, err
+	}
+	targets := []PollTarget{}
+	if err := yaml.UnmarshalStrict(content, &targets); err != nil {
+		return nil, err
+	}
+	for _, t := range targets {
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+	}
+	return targets, nil
+}
+
+func (f *TargetFile) String() string {
+	return fmt.Sprintf("file %s", f.Path)
+}
+
+// The targets to poll, for MySQLSource.LoadTargets.
+const loadPollTargetsQuery = `
+SELECT target, module, org_id, sys_id, interval_seconds
+FROM cw_snmp_poll_targets
+ORDER BY id`
+
+// LoadTargets reads the targets to poll from the cw_snmp_poll_targets table.
+func (s *MySQLSource) LoadTargets() ([]PollTarget, error) {
+	ctx := context.Background()
+	if s.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.timeout)
+		defer cancel()
+	}
+	if err := s.db.PingContext(ctx); err != nil {
+		return nil, fmt.Errorf("Error connecting to database: %s", err)
+	}
+	if err := s.checkSchema(ctx); err != nil {
+		return nil, err
+	}
+	rows, err := s.query(ctx, loadPollTargetsQuery)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying targets to poll: %s", err)
+	}
+	defer rows.Close()
+	targets := []PollTarget{}
+	for rows.Next() {
+		var t PollTarget
+		var interval float64
+		if err := rows.Scan(&t.Target, &t.Module, &t.OrgID, &t.SysID, &interval); err != nil {
+			return nil, fmt.Errorf("Error reading targets to poll: %s", err)
+		}
+		t.Interval = time.Duration(interval * float64(time.Second))
+		if err := t.Validate(); err != nil {
+			return nil, err
+		}
+		targets = append(targets, t)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("Error reading targets to poll: %s", err)
+	}
+	return targets, nil
+}
@@ -0,0 +1,83 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package config
+
+// visibleTo returns whether a metric may be scraped on behalf of a tenant.
+// Metrics without an org are shared by everyone, metrics without a sys are
+// shared by the whole org.
+func (m *Metric) visibleTo(org, sys int) bool {
+	if m.OrgID == 0 {
+		return true
+	}
+	return m.OrgID == org && (m.SysID == 0 || m.SysID == sys)
+}
+
+// relatesTo returns whether a walked or fetched OID is needed by the metric,
+// either for its value or for one of its lookups.
+func (m *Metric) relatesTo(oid string) bool {
+	if oidWithin(m.Oid, oid) || oidWithin(oid, m.Oid) {
+		return true
+	}
+	for _, lookup := range m.Lookups {
+		if oidWithin(lookup.Oid, oid) || oidWithin(oid, lookup.Oid) {
+			return true
+		}
+	}
+	return false
+}
+
+// ForTenant returns the module as seen by a tenant, without the metrics of
+// other orgs and systems, and without the OIDs that only those metrics need.
+// An org of 0 sees only the shared metrics.
+func (c *Module) ForTenant(org, sys int) *Module {
+	var visible, hidden []*Metric
+	for _, metric := range c.Metrics {
+		if metric.visibleTo(org, sys) {
+			visible = append(visible, metric)
+		} else {
+			hidden = append(hidden, metric)
+		}
+	}
+	if len(hidden) == 0 {
+		return c
+	}
+
+	needed := func(oid string) bool {
+		for _, metric := range visible {
+			if metric.relatesTo(oid) {
+				return true
+			}
+		}
+		for _, metric := range hidden {
+			if metric.relatesTo(oid) {
+				return false
+			}
+		}
+		return true
+	}
+	m := *c
+	m.Metrics = visible
+	m.Walk, m.Get = nil, nil
+	for _, oid := range c.Walk {
+		if needed(oid) {
+			m.Walk = append(m.Walk, oid)
+		}
+	}
+	for _, oid := range c.Get {
+		if needed(oid) {
+			m.Get = append(m.Get, oid)
+		}
+	}
+	return &m
+}
@@ -14,15 +14,27 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/config"
 )
 
 func TestHideConfigSecrets(t *testing.T) {
 	sc := &SafeConfig{}
-	err := sc.ReloadConfig("testdata/snmp-auth.yml")
+	err := sc.ReloadConfig(&config.FileSource{Path: "testdata/snmp-auth.yml"})
 	if err != nil {
 		t.Errorf("Error loading config %v: %v", "testdata/snmp-auth.yml", err)
 	}
@@ -41,7 +53,7 @@ func TestHideConfigSecrets(t *testing.T) {
 
 func TestLoadConfigWithOverrides(t *testing.T) {
 	sc := &SafeConfig{}
-	err := sc.ReloadConfig("testdata/snmp-with-overrides.yml")
+	err := sc.ReloadConfig(&config.FileSource{Path: "testdata/snmp-with-overrides.yml"})
 	if err != nil {
 		t.Errorf("Error loading config %v: %v", "testdata/snmp-with-overrides.yml", err)
 	}
@@ -52,3 +64,575 @@ func TestLoadConfigWithOverrides(t *testing.T) {
 		t.Errorf("Error marshalling config: %v", err)
 	}
 }
+
+func TestLoadConfigOverHTTP(t *testing.T) {
+	content, err := ioutil.ReadFile("testdata/snmp-with-overrides.yml")
+	if err != nil {
+		t.Fatalf("Error reading testdata: %v", err)
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer ts.Close()
+
+	sc := &SafeConfig{}
+	err = sc.ReloadConfig(&config.HTTPSource{URL: ts.URL})
+	if err != nil {
+		t.Fatalf("Error loading config from %v: %v", ts.URL, err)
+	}
+	if _, ok := (*sc.C)["default"]; !ok {
+		t.Errorf("Module 'default' missing from config loaded over http")
+	}
+
+	ts.Config.Handler = http.NotFoundHandler()
+	if err := sc.ReloadConfig(&config.HTTPSource{URL: ts.URL}); err == nil {
+		t.Errorf("Expected error loading config from failing url")
+	}
+}
+
+func TestMySQLSourceUnreachable(t *testing.T) {
+	source, err := config.NewMySQLSource(config.MySQLConfig{
+		DSN:     "user:pass@tcp(127.0.0.1:1)/snmp",
+		Timeout: time.Second,
+	})
+	if err != nil {
+		t.Fatalf("Error creating MySQL source: %v", err)
+	}
+	sc := &SafeConfig{C: &config.Config{}}
+	if err := sc.ReloadConfig(source); err == nil {
+		t.Fatal("Expected error loading config from unreachable database")
+	}
+	if _, err := source.Migrate(context.Background()); err == nil {
+		t.Fatal("Expected error migrating unreachable database")
+	}
+	if strings.Contains(source.String(), "pass") {
+		t.Errorf("MySQL source description reveals the password: %s", source)
+	}
+
+	if _, err := config.NewMySQLSource(config.MySQLConfig{}); err == nil {
+		t.Error("Expected error creating MySQL source without a DSN")
+	}
+}
+
+func TestSecretKeyRoundTrip(t *testing.T) {
+	key, err := config.ParseSecretKey("MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=")
+	if err != nil {
+		t.Fatalf("Error parsing secret key: %v", err)
+	}
+	encrypted, err := key.Encrypt("mysecret")
+	if err != nil {
+		t.Fatalf("Error encrypting secret: %v", err)
+	}
+	if strings.Contains(encrypted, "mysecret") {
+		t.Fatalf("Encrypted secret reveals the secret: %s", encrypted)
+	}
+	decrypted, err := key.Decrypt(encrypted)
+	if err != nil {
+		t.Fatalf("Error decrypting secret: %v", err)
+	}
+	if decrypted != "mysecret" {
+		t.Errorf("Decrypted secret %q, want %q", decrypted, "mysecret")
+	}
+
+	otherKey, err := config.ParseSecretKey("ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA=")
+	if err != nil {
+		t.Fatalf("Error parsing secret key: %v", err)
+	}
+	if _, err := otherKey.Decrypt(encrypted); err == nil {
+		t.Error("Expected error decrypting with the wrong key")
+	}
+	if _, err := config.ParseSecretKey("c2hvcnQ="); err == nil {
+		t.Error("Expected error parsing a short key")
+	}
+}
+
+func TestWalkParamsValidate(t *testing.T) {
+	cases := []struct {
+		auth        config.Auth
+		version     int
+		concurrency int
+		shouldErr   bool
+	}{
+		{version: 2},
+		{version: 4, shouldErr: true},
+		{version: 2, concurrency: 4},
+		{version: 2, concurrency: -1, shouldErr: true},
+		{version: 3, auth: config.Auth{SecurityLevel: "noAuthNoPriv"}, shouldErr: true},
+		{version: 3, auth: config.Auth{SecurityLevel: "noAuthNoPriv", Username: "user"}},
+		{version: 3, auth: config.Auth{SecurityLevel: "authNoPriv", Username: "user", AuthProtocol: "SHA"}, shouldErr: true},
+		{version: 3, auth: config.Auth{SecurityLevel: "authNoPriv", Username: "user", Password: "pass", AuthProtocol: "SHA"}},
+		{version: 3, auth: config.Auth{SecurityLevel: "authPriv", Username: "user", Password: "pass", AuthProtocol: "SHA", PrivPassword: "priv", PrivProtocol: "3DES"}, shouldErr: true},
+	}
+	for i, c := range cases {
+		wp := config.DefaultWalkParams
+		wp.Version = c.version
+		wp.Auth = c.auth
+		wp.WalkConcurrency = c.concurrency
+		err := wp.Validate()
+		if c.shouldErr && err == nil {
+			t.Errorf("%d: Expected error validating %+v", i, wp)
+		}
+		if !c.shouldErr && err != nil {
+			t.Errorf("%d: Unexpected error validating %+v: %v", i, wp, err)
+		}
+	}
+}
+
+func TestModuleForTenant(t *testing.T) {
+	module := &config.Module{
+		Walk: []string{"1.1.1", "1.1.2", "1.1.3", "1.1.9"},
+		Get:  []string{"1.1.4.0"},
+		Metrics: []*config.Metric{
+			{Name: "shared", Oid: "1.1.1"},
+			{Name: "org1", Oid: "1.1.2", OrgID: 1},
+			{Name: "org1sys2", Oid: "1.1.3", OrgID: 1, SysID: 2},
+			{Name: "org2", Oid: "1.1.4", OrgID: 2},
+		},
+	}
+
+	cases := []struct {
+		org, sys int
+		metrics  []string
+		walk     []string
+		get      []string
+	}{
+		{0, 0, []string{"shared"}, []string{"1.1.1", "1.1.9"}, nil},
+		{1, 0, []string{"shared", "org1"}, []string{"1.1.1", "1.1.2", "1.1.9"}, nil},
+		{1, 2, []string{"shared", "org1", "org1sys2"}, []string{"1.1.1", "1.1.2", "1.1.3", "1.1.9"}, nil},
+		{2, 0, []string{"shared", "org2"}, []string{"1.1.1", "1.1.9"}, []string{"1.1.4.0"}},
+	}
+	for _, c := range cases {
+		m := module.ForTenant(c.org, c.sys)
+		var metrics []string
+		for _, metric := range m.Metrics {
+			metrics = append(metrics, metric.Name)
+		}
+		if !reflect.DeepEqual(metrics, c.metrics) {
+			t.Errorf("org %d sys %d: got metrics %v, want %v", c.org, c.sys, metrics, c.metrics)
+		}
+		if !reflect.DeepEqual(m.Walk, c.walk) {
+			t.Errorf("org %d sys %d: got walk %v, want %v", c.org, c.sys, m.Walk, c.walk)
+		}
+		if !reflect.DeepEqual(m.Get, c.get) {
+			t.Errorf("org %d sys %d: got get %v, want %v", c.org, c.sys, m.Get, c.get)
+		}
+	}
+	if len(module.Metrics) != 4 {
+		t.Errorf("ForTenant modified the module")
+	}
+}
+
+func TestReloadKeepsUnchangedModules(t *testing.T) {
+	sc := &SafeConfig{}
+	source := &config.FileSource{Path: "testdata/snmp-with-overrides.yml"}
+	if err := sc.ReloadConfig(source); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	before := (*sc.C)["default"]
+	if err := sc.ReloadConfig(source); err != nil {
+		t.Fatalf("Error reloading config: %v", err)
+	}
+	if (*sc.C)["default"] != before {
+		t.Error("Unchanged module was replaced on reload")
+	}
+}
+
+func TestConfigUpdate(t *testing.T) {
+	a := &config.Module{Walk: []string{"1.1"}}
+	b := &config.Module{Walk: []string{"1.2"}}
+	old := config.Config{"same": a, "modified": a, "removed": a}
+	updated, changes := config.Update(old, config.Config{
+		"same":     &config.Module{Walk: []string{"1.1"}},
+		"modified": b,
+		"added":    b,
+	})
+	want := config.Changes{Added: []string{"added"}, Removed: []string{"removed"}, Modified: []string{"modified"}}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("Got changes %+v, want %+v", changes, want)
+	}
+	if updated["same"] != a || updated["modified"] != b || len(updated) != 3 {
+		t.Errorf("Unexpected updated config %v", updated)
+	}
+	if _, changes := config.Update(updated, updated); !changes.Empty() {
+		t.Errorf("Expected no changes, got %+v", changes)
+	}
+}
+
+func TestFallBackToSnapshot(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	snapshot := filepath.Join(dir, "snapshot.yml")
+
+	sc := &SafeConfig{SnapshotFile: snapshot}
+	if err := sc.ReloadConfig(&config.FileSource{Path: "testdata/snmp-auth.yml"}); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	info, err := os.Stat(snapshot)
+	if err != nil {
+		t.Fatalf("Snapshot was not written: %v", err)
+	}
+	if mode := info.Mode().Perm(); mode != 0600 {
+		t.Errorf("Snapshot has mode %v, want 0600", mode)
+	}
+
+	restarted := &SafeConfig{SnapshotFile: snapshot}
+	if err := restarted.ReloadConfig(&config.FileSource{Path: filepath.Join(dir, "missing.yml")}); err == nil {
+		t.Fatal("Expected an error loading a missing file")
+	}
+	if _, age := restarted.Stale(); age != 0 {
+		t.Errorf("Expected age 0 before any config is loaded, got %v", age)
+	}
+	configModuleMetrics.Reset()
+	if err := restarted.LoadSnapshot(); err != nil {
+		t.Fatalf("Error loading snapshot: %v", err)
+	}
+	got, want := (*restarted.C)["module-auth-test"].WalkParams, (*sc.C)["module-auth-test"].WalkParams
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Snapshot differs from the loaded config, secrets included:\n%v\n%v", got, want)
+	}
+	if stale, age := restarted.Stale(); !stale || age < 0 {
+		t.Errorf("Config from snapshot should be stale, got stale %v and age %v", stale, age)
+	}
+	ch := make(chan prometheus.Metric, 10)
+	configModuleMetrics.Collect(ch)
+	if len(ch) != len(*restarted.C) {
+		t.Errorf("Expected the metrics of the %d modules of the snapshot, got %d", len(*restarted.C), len(ch))
+	}
+	if stale, _ := sc.Stale(); stale {
+		t.Error("Config loaded from its source should not be stale")
+	}
+}
+
+func TestReloadHistory(t *testing.T) {
+	h := newReloadHistory(2)
+	h.add(reloadRecord{Source: "first", Success: true})
+	h.add(reloadRecord{Source: "second", Error: "broken"})
+	h.add(reloadRecord{Source: "third", Success: true})
+
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", "/-/reload/history", nil))
+	var got []reloadRecord
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("Error decoding history: %v", err)
+	}
+	if len(got) != 2 || got[0].Source != "third" || got[1].Source != "second" {
+		t.Fatalf("Expected the two most recent reloads, newest first, got %v", got)
+	}
+	if got[1].Error != "broken" || got[1].Success {
+		t.Errorf("Failed reload not recorded as such: %v", got[1])
+	}
+}
+
+func TestModuleExtends(t *testing.T) {
+	cfg, err := config.LoadFile("testdata/snmp-extends.yml")
+	if err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	child := (*cfg)["child"]
+	if !reflect.DeepEqual(child.Walk, []string{"1.1.1", "1.2.1"}) {
+		t.Errorf("Unexpected walk %v", child.Walk)
+	}
+	var metrics []string
+	for _, m := range child.Metrics {
+		metrics = append(metrics, m.Name+":"+m.Type)
+	}
+	if want := []string{"baseMetric:gauge", "sharedMetric:counter", "childMetric:gauge"}; !reflect.DeepEqual(metrics, want) {
+		t.Errorf("Expected metrics %v, got %v", want, metrics)
+	}
+	wp := child.WalkParams
+	if wp.Version != 3 || wp.MaxRepetitions != 10 || wp.Auth.Username != "user" || wp.Auth.Password != "mysecret" || !wp.PartialResults {
+		t.Errorf("Walk parameters not merged: %+v", wp)
+	}
+	if len((*cfg)["base"].Metrics) != 2 {
+		t.Error("Parent module was changed by resolving its child")
+	}
+	// Walk parameters set to their default still replace those extended.
+	wp = (*cfg)["defaults"].WalkParams
+	if wp.Version != 2 || wp.Retries != 3 || wp.PartialResults || wp.Auth.Community != "public" || wp.MaxRepetitions != 10 {
+		t.Errorf("Walk parameters set to their default not merged: %+v", wp)
+	}
+
+	resolved := *child
+	if err := cfg.Resolve(); err != nil {
+		t.Fatalf("Error resolving config again: %v", err)
+	}
+	if !reflect.DeepEqual(*(*cfg)["child"], resolved) {
+		t.Error("Resolving a resolved config changed it")
+	}
+
+	_, err = config.LoadFile("testdata/snmp-extends-cycle.yml")
+	if err == nil || !strings.Contains(err.Error(), "extends itself") {
+		t.Errorf("Expected cycle error, got %v", err)
+	}
+}
+
+func TestLoadConfigDirectory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.yml", "first:\n  metrics: []\n")
+	write("b.yaml", "second:\n  metrics: []\nfirst:\n  metrics: []\n")
+	write("ignored.txt", "not: [yaml")
+
+	for _, path := range []string{dir, filepath.Join(dir, "*.y*ml")} {
+		source := &config.FileSource{Path: path}
+		cfg, err := source.Load()
+		if _, ok := err.(*config.PartialError); !ok || !strings.Contains(err.Error(), "a.yml") || !strings.Contains(err.Error(), "b.yaml") {
+			t.Fatalf("Expected duplicate module error naming both files from %s, got %v", path, err)
+		}
+		if len(*cfg) != 2 {
+			t.Fatalf("Expected modules of both files from %s, got %v", path, *cfg)
+		}
+
+		write("b.yaml", "second: [broken")
+		cfg, err = source.Load()
+		if _, ok := err.(*config.PartialError); !ok || !strings.Contains(err.Error(), "b.yaml") {
+			t.Fatalf("Expected error for broken file, got %v", err)
+		}
+		if _, ok := (*cfg)["second"]; !ok {
+			t.Error("Modules of a broken file were dropped")
+		}
+		write("b.yaml", "second:\n  metrics: []\n")
+		if _, err := source.Load(); err != nil {
+			t.Fatalf("Error loading fixed files: %v", err)
+		}
+		write("b.yaml", "second:\n  metrics: []\nfirst:\n  metrics: []\n")
+	}
+}
+
+func TestLoadConfigDirectoryResolveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	write := func(name, content string) {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("a.yml", "base:\n  metrics: []\n  version: 1\nchild:\n  extends: [base]\n  metrics: []\n")
+	write("b.yml", "orphan:\n  extends: [missing]\n  metrics: []\nv3:\n  extends: [base]\n  version: 3\n  metrics: []\n")
+
+	cfg, err := (&config.FileSource{Path: dir}).Load()
+	if _, ok := err.(*config.PartialError); !ok {
+		t.Fatalf("Expected a partial error, got %v", err)
+	}
+	for _, want := range []string{"b.yml", "orphan extends unknown module missing", "Module v3: Auth username is missing"} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("Expected error to contain %q, got %v", want, err)
+		}
+	}
+	if cfg == nil {
+		t.Fatal("Expected the modules that resolve to be loaded")
+	}
+	if _, ok := (*cfg)["child"]; !ok || len(*cfg) != 2 {
+		t.Errorf("Expected only base and child to be loaded, got %v", *cfg)
+	}
+	if (*cfg)["child"].WalkParams.Version != 1 {
+		t.Error("Expected child to be resolved")
+	}
+}
+
+func TestSecretReferences(t *testing.T) {
+	dir, err := ioutil.TempDir("", "snmp_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	passwordFile := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(passwordFile, []byte("filesecret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	os.Setenv("SNMP_EXPORTER_TEST_COMMUNITY", "envsecret")
+	defer os.Unsetenv("SNMP_EXPORTER_TEST_COMMUNITY")
+	configFile := filepath.Join(dir, "snmp.yml")
+	content := `
+module:
+  version: 3
+  auth:
+    community: prefix-${SNMP_EXPORTER_TEST_COMMUNITY}
+    security_level: authNoPriv
+    username: user
+    password_file: ` + passwordFile + "\n"
+	if err := ioutil.WriteFile(configFile, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sc := &SafeConfig{}
+	if err := sc.ReloadConfig(&config.FileSource{Path: configFile}); err != nil {
+		t.Fatalf("Error loading config: %v", err)
+	}
+	auth := (*sc.C)["module"].WalkParams.Auth
+	if auth.Community != "prefix-envsecret" || auth.Password != "filesecret" {
+		t.Errorf("Secrets not resolved, got community %q and password %q", auth.Community, auth.Password)
+	}
+	c, err := yaml.Marshal(sc.C)
+	if err != nil {
+		t.Fatalf("Error marshalling config: %v", err)
+	}
+	if strings.Contains(string(c), "envsecret") || strings.Contains(string(c), "filesecret") {
+		t.Errorf("Marshalled config reveals resolved secrets:\n%s", c)
+	}
+
+	// A rotated secret is picked up by the next reload.
+	if err := ioutil.WriteFile(passwordFile, []byte("rotated"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := sc.ReloadConfig(&config.FileSource{Path: configFile}); err != nil {
+		t.Fatalf("Error reloading config: %v", err)
+	}
+	if got := (*sc.C)["module"].WalkParams.Auth.Password; got != "rotated" {
+		t.Errorf("Rotated password not reloaded, got %q", got)
+	}
+
+	os.Unsetenv("SNMP_EXPORTER_TEST_COMMUNITY")
+	if _, err := config.LoadFile(configFile); err == nil {
+		t.Error("Expected error for unset environment variable")
+	}
+}
+
+func TestModuleList(t *testing.T) {
+	for in, want := range map[string]string{
+		"":               "",
+		"if_mib":         "if_mib",
+		"if_mib,cpu":     "cpu,if_mib",
+		"cpu,if_mib,cpu": "cpu,if_mib",
+		"cpu,cpu":        "cpu",
+	} {
+		if got := moduleList(in); got != want {
+			t.Errorf("moduleList(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestMergeModules(t *testing.T) {
+	shared := &config.Metric{Name: "ifMtu", Oid: "1.3.6.1.2.1.2.2.1.4", Type: "gauge"}
+	cfg := config.Config{
+		"if_mib": {
+			Walk:       []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31.1.1"},
+			Get:        []string{"1.3.6.1.2.1.1.3.0"},
+			Metrics:    []*config.Metric{shared},
+			WalkParams: config.DefaultWalkParams,
+		},
+		"if_table": {
+			Walk:       []string{"1.3.6.1.2.1.2.2"},
+			Metrics:    []*config.Metric{shared},
+			WalkParams: config.DefaultWalkParams,
+		},
+		"cpu": {
+			Walk:       []string{"1.3.6.1.4.1.9.9.109"},
+			Get:        []string{"1.3.6.1.2.1.1.3.0", "1.3.6.1.2.1.2.1.0"},
+			Metrics:    []*config.Metric{{Name: "cpuBusy", Oid: "1.3.6.1.4.1.9.9.109.1.1.1.1.7", Type: "gauge"}},
+			WalkParams: config.DefaultWalkParams,
+		},
+		"conflict": {
+			Metrics:    []*config.Metric{{Name: "ifMtu", Oid: "1.3.6.1.2.1.2.2.1.5", Type: "gauge"}},
+			WalkParams: config.DefaultWalkParams,
+		},
+	}
+
+	merged, err := cfg.Merge([]string{"if_mib", "if_table", "cpu"})
+	if err != nil {
+		t.Fatalf("Error merging modules: %v", err)
+	}
+	if want := []string{"1.3.6.1.2.1.2", "1.3.6.1.2.1.31.1.1", "1.3.6.1.4.1.9.9.109"}; !reflect.DeepEqual(merged.Walk, want) {
+		t.Errorf("Expected walk %v, got %v", want, merged.Walk)
+	}
+	if want := []string{"1.3.6.1.2.1.1.3.0"}; !reflect.DeepEqual(merged.Get, want) {
+		t.Errorf("Expected get %v, got %v", want, merged.Get)
+	}
+	if len(merged.Metrics) != 2 {
+		t.Errorf("Expected the shared metric once plus cpuBusy, got %d metrics", len(merged.Metrics))
+	}
+
+	merged, err = cfg.Merge([]string{"cpu", "cpu"})
+	if err != nil {
+		t.Fatalf("Error merging a module with itself: %v", err)
+	}
+	if len(merged.Metrics) != 1 {
+		t.Errorf("Expected a module listed twice to be merged once, got %d metrics", len(merged.Metrics))
+	}
+
+	if _, err := cfg.Merge([]string{"if_mib", "conflict"}); err == nil {
+		t.Error("Expected error merging modules with conflicting metric names")
+	}
+	if _, err := cfg.Merge([]string{"if_mib", "missing"}); err == nil {
+		t.Error("Expected error merging an unknown module")
+	}
+}
+
+func TestModuleCacheTTL(t *testing.T) {
+	module := &config.Module{
+		Metrics: []*config.Metric{
+			{Name: "ifDescr", Oid: "1.3.6.1.2.1.2.2.1.2", CacheTTL: time.Hour},
+			{Name: "ifMtu", Oid: "1.3.6.1.2.1.2.2.1.4"},
+			{Name: "sysDescr", Oid: "1.3.6.1.2.1.1.1", CacheTTL: time.Hour},
+			{
+				Name:    "ifHCInOctets",
+				Oid:     "1.3.6.1.2.1.31.1.1.1.6",
+				Lookups: []*config.Lookup{{Labelname: "ifAlias", Oid: "1.3.6.1.2.1.31.1.1.1.18", CacheTTL: time.Minute}},
+			},
+			{Name: "ifAlias", Oid: "1.3.6.1.2.1.31.1.1.1.18", CacheTTL: 5 * time.Minute},
+		},
+	}
+	for oid, want := range map[string]time.Duration{
+		"1.3.6.1.2.1.2.2.1.2":     time.Hour,
+		"1.3.6.1.2.1.1.1.0":       time.Hour,
+		"1.3.6.1.2.1.31.1.1.1.18": time.Minute,
+		// Tables with columns that are not cached.
+		"1.3.6.1.2.1.2.2":      0,
+		"1.3.6.1.2.1.31.1.1.1": 0,
+		// Nothing reads from it.
+		"1.3.6.1.4.1": 0,
+	} {
+		if got := module.CacheTTL(oid); got != want {
+			t.Errorf("Expected cache TTL %v for %s, got %v", want, oid, got)
+		}
+	}
+}
+
+func TestLoadPollTargets(t *testing.T) {
+	source := &config.TargetFile{Path: "testdata/targets.yml"}
+	targets, err := source.LoadTargets()
+	if err != nil {
+		t.Fatalf("Error loading targets: %v", err)
+	}
+	want := []config.PollTarget{
+		{Target: "192.168.1.2", Module: "if_mib"},
+		{Target: "192.168.1.3:1161", Module: "if_mib,cisco_cpu", OrgID: 12, SysID: 3, Interval: 5 * time.Minute},
+	}
+	if !reflect.DeepEqual(targets, want) {
+		t.Errorf("Expected targets %v, got %v", want, targets)
+	}
+
+	dir, err := ioutil.TempDir("", "snmp_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	source.Path = filepath.Join(dir, "targets.yml")
+	for _, content := range []string{
+		"- module: if_mib\n",
+		"- target: 1.2.3.4\n",
+		"- target: 1.2.3.4\n  module: if_mib\n  sys_id: 3\n",
+		"- target: 1.2.3.4\n  module: if_mib\n  unknown: field\n",
+	} {
+		if err := ioutil.WriteFile(source.Path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := source.LoadTargets(); err == nil {
+			t.Errorf("Expected error loading targets %q", content)
+		}
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+
+	"github.com/prometheus/common/log"
+	yaml "gopkg.in/yaml.v2"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// newMySQLSource connects to the configuration database given by the
+// --config.mysql.* flags.
+func newMySQLSource() (*config.MySQLSource, error) {
+	return config.NewMySQLSource(config.MySQLConfig{
+		DSN:                   *mysqlDSN,
+		DSNFile:               *mysqlDSNFile,
+		TLSCAFile:             *mysqlTLSCA,
+		TLSCertFile:           *mysqlTLSCert,
+		TLSKeyFile:            *mysqlTLSKey,
+		TLSServerName:         *mysqlTLSName,
+		TLSInsecureSkipVerify: *mysqlTLSSkip,
+		MaxOpenConns:          *mysqlMaxOpen,
+		MaxIdleConns:          *mysqlMaxIdle,
+		ConnMaxLifetime:       *mysqlLifetime,
+		Timeout:               *mysqlTimeout,
+		SecretKey:             *mysqlKey,
+		SecretKeyFile:         *mysqlKeyFile,
+	})
+}
+
+// migrateDB runs the "db migrate" command.
+func migrateDB() error {
+	source, err := newMySQLSource()
+	if err != nil {
+		return err
+	}
+	from, err := source.Migrate(context.Background())
+	if err != nil {
+		return err
+	}
+	if from == config.SchemaVersion {
+		log.Infof("Schema of %s is already at version %d", source, from)
+	} else {
+		log.Infof("Migrated schema of %s from version %d to %d", source, from, config.SchemaVersion)
+	}
+	return nil
+}
+
+// importConfig runs the "config import" command.
+func importConfig() error {
+	// Import the modules as written, so that they keep extending others and
+	// referring to secrets rather than holding them.
+	conf, err := config.ReadRawFile(*configImportFile)
+	if err != nil {
+		return err
+	}
+	source, err := newMySQLSource()
+	if err != nil {
+		return err
+	}
+	if err := source.Import(*conf, *configImportPrune); err != nil {
+		return err
+	}
+	log.Infof("Imported %d modules from %s into %s", len(*conf), *configImportFile, source)
+	return nil
+}
+
+// exportConfig runs the "config export" command.
+func exportConfig() error {
+	source, err := newMySQLSource()
+	if err != nil {
+		return err
+	}
+	// Export the modules as stored, so that importing them back changes
+	// nothing.
+	conf, err := source.Export()
+	if err != nil {
+		return err
+	}
+	config.DoNotHideSecrets = *configExportSecrets
+	content, err := yaml.Marshal(conf)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(content)
+	return err
+}
@@ -0,0 +1,144 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/soniah/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+var (
+	engineCacheLookups = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snmp_engine_cache_lookups_total",
+			Help: "Lookups of the discovered SNMPv3 engine of a target, by whether it was cached.",
+		},
+		[]string{"result"},
+	)
+	engineCacheInvalidations = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "snmp_engine_cache_invalidations_total",
+			Help: "Cached SNMPv3 engines dropped because the target rejected them or a scrape failed.",
+		},
+	)
+
+	// SNMPv3 engines discovered, across scrapes.
+	targetEngines = newEngineCache()
+)
+
+func init() {
+	prometheus.MustRegister(engineCacheLookups)
+	prometheus.MustRegister(engineCacheInvalidations)
+}
+
+// engineKey identifies the USM security parameters of a target. The keys
+// are localized from the passphrases, so all the credentials are part of it.
+type engineKey struct {
+	target string
+	auth   config.Auth
+}
+
+type engineEntry struct {
+	params          *gosnmp.UsmSecurityParameters
+	contextEngineID string
+	stored          time.Time
+}
+
+// engineCache keeps the engine ID, boots and time and the localized keys
+// discovered by SNMPv3 sessions, so that later sessions to the target can
+// skip discovery.
+type engineCache struct {
+	mtx     sync.Mutex
+	entries map[engineKey]engineEntry
+	purged  time.Time
+}
+
+func newEngineCache() *engineCache {
+	return &engineCache{entries: map[engineKey]engineEntry{}}
+}
+
+// restore gives an SNMPv3 session the security parameters cached for the
+// target, with the engine time moved on by the time since they were stored.
+// It returns whether there were any younger than ttl.
+func (c *engineCache) restore(target string, wp config.WalkParams, snmp *gosnmp.GoSNMP, ttl time.Duration) bool {
+	if snmp.Version != gosnmp.Version3 || ttl <= 0 {
+		return false
+	}
+	key := engineKey{target, wp.Auth}
+	c.mtx.Lock()
+	entry, ok := c.entries[key]
+	if ok && time.Since(entry.stored) >= ttl {
+		delete(c.entries, key)
+		ok = false
+	}
+	c.mtx.Unlock()
+	if !ok {
+		engineCacheLookups.WithLabelValues("miss").Inc()
+		return false
+	}
+	engineCacheLookups.WithLabelValues("hit").Inc()
+	params := entry.params.Copy().(*gosnmp.UsmSecurityParameters)
+	params.AuthoritativeEngineTime += uint32(time.Since(entry.stored).Seconds())
+	snmp.SecurityParameters = params
+	snmp.ContextEngineID = entry.contextEngineID
+	return true
+}
+
+// update stores the security parameters of an SNMPv3 session after a
+// scrape. The cached ones are dropped instead if the scrape failed, or if
+// the target reported a different engine ID or number of boots than cached,
+// as it does along with unknownEngineID and notInTimeWindow reports.
+func (c *engineCache) update(target string, wp config.WalkParams, snmp *gosnmp.GoSNMP, failed bool, ttl time.Duration) {
+	if snmp.Version != gosnmp.Version3 || ttl <= 0 {
+		return
+	}
+	params, ok := snmp.SecurityParameters.(*gosnmp.UsmSecurityParameters)
+	if !ok {
+		return
+	}
+	key := engineKey{target, wp.Auth}
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	now := time.Now()
+	if now.Sub(c.purged) >= ttl {
+		for k, entry := range c.entries {
+			if now.Sub(entry.stored) >= ttl {
+				delete(c.entries, k)
+			}
+		}
+		c.purged = now
+	}
+
+	cached, ok := c.entries[key]
+	if ok && (failed ||
+		cached.params.AuthoritativeEngineID != params.AuthoritativeEngineID ||
+		cached.params.AuthoritativeEngineBoots != params.AuthoritativeEngineBoots) {
+		delete(c.entries, key)
+		engineCacheInvalidations.Inc()
+		return
+	}
+	if failed || params.AuthoritativeEngineID == "" {
+		return
+	}
+	c.entries[key] = engineEntry{
+		params:          params.Copy().(*gosnmp.UsmSecurityParameters),
+		contextEngineID: snmp.ContextEngineID,
+		stored:          now,
+	}
+}
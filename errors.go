@@ -0,0 +1,157 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/soniah/gosnmp"
+)
+
+// Classes scrape errors are counted under.
+const (
+	errorTimeout    = "timeout"
+	errorAuth       = "auth_failure"
+	errorTooBig     = "too_big"
+	errorGenErr     = "gen_err"
+	errorNoSuchName = "no_such_name"
+	errorDecode     = "decode_error"
+	// The scrape ran out of time waiting for other walks of the target.
+	errorLimited = "limited"
+	errorOther   = "other"
+)
+
+var (
+	errorClasses = []string{errorTimeout, errorAuth, errorTooBig, errorGenErr, errorNoSuchName, errorDecode, errorLimited, errorOther}
+
+	snmpScrapeErrors = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "snmp_scrape_errors_total",
+			Help: "Failed scrapes of targets, by class of error.",
+		},
+		[]string{"class"},
+	)
+
+	// Names of the error statuses of RFC 3416.
+	snmpErrorNames = map[gosnmp.SNMPError]string{
+		gosnmp.NoError:             "noError",
+		gosnmp.TooBig:              "tooBig",
+		gosnmp.NoSuchName:          "noSuchName",
+		gosnmp.BadValue:            "badValue",
+		gosnmp.ReadOnly:            "readOnly",
+		gosnmp.GenErr:              "genErr",
+		gosnmp.NoAccess:            "noAccess",
+		gosnmp.WrongType:           "wrongType",
+		gosnmp.WrongLength:         "wrongLength",
+		gosnmp.WrongEncoding:       "wrongEncoding",
+		gosnmp.WrongValue:          "wrongValue",
+		gosnmp.NoCreation:          "noCreation",
+		gosnmp.InconsistentValue:   "inconsistentValue",
+		gosnmp.ResourceUnavailable: "resourceUnavailable",
+		gosnmp.CommitFailed:        "commitFailed",
+		gosnmp.UndoFailed:          "undoFailed",
+		gosnmp.AuthorizationError:  "authorizationError",
+		gosnmp.NotWritable:         "notWritable",
+		gosnmp.InconsistentName:    "inconsistentName",
+	}
+
+	// Names of the USM statistics SNMPv3 agents report errors with.
+	usmReportNames = map[string]string{
+		".1.3.6.1.6.3.15.1.1.1.0": "unsupportedSecLevel",
+		".1.3.6.1.6.3.15.1.1.2.0": "notInTimeWindow",
+		".1.3.6.1.6.3.15.1.1.3.0": "unknownUserName",
+		".1.3.6.1.6.3.15.1.1.4.0": "unknownEngineID",
+		".1.3.6.1.6.3.15.1.1.5.0": "wrongDigest",
+		".1.3.6.1.6.3.15.1.1.6.0": "decryptionError",
+	}
+)
+
+func init() {
+	for _, class := range errorClasses {
+		snmpScrapeErrors.WithLabelValues(class)
+	}
+	prometheus.MustRegister(snmpScrapeErrors)
+}
+
+// scrapeError is an error of a scrape, with its class.
+type scrapeError struct {
+	class string
+	msg   string
+}
+
+func (e *scrapeError) Error() string {
+	return e.msg
+}
+
+// wrapError prefixes an error with what failed, keeping its class.
+func wrapError(err error, format string, args ...interface{}) error {
+	return &scrapeError{
+		class: errorClass(err),
+		msg:   fmt.Sprintf(format, args...) + ": " + err.Error(),
+	}
+}
+
+// statusError is the error for a response with an error status.
+func statusError(target string, status gosnmp.SNMPError) error {
+	class := errorOther
+	switch status {
+	case gosnmp.TooBig:
+		class = errorTooBig
+	case gosnmp.GenErr:
+		class = errorGenErr
+	case gosnmp.NoSuchName:
+		class = errorNoSuchName
+	case gosnmp.NoAccess, gosnmp.AuthorizationError:
+		class = errorAuth
+	}
+	return &scrapeError{class: class, msg: fmt.Sprintf("Error reported by target %s: %s", target, snmpErrorName(status))}
+}
+
+// reportError is the error for a report the session could not recover from,
+// such as one of wrong credentials.
+func reportError(target string, packet *gosnmp.SnmpPacket) error {
+	name := packet.Variables[0].Name
+	if n, ok := usmReportNames[name]; ok {
+		return &scrapeError{class: errorAuth, msg: fmt.Sprintf("Error reported by target %s: %s", target, n)}
+	}
+	return &scrapeError{class: errorOther, msg: fmt.Sprintf("Error reported by target %s: report %s", target, name)}
+}
+
+func snmpErrorName(status gosnmp.SNMPError) string {
+	if name, ok := snmpErrorNames[status]; ok {
+		return name
+	}
+	return fmt.Sprintf("error status %d", status)
+}
+
+// errorClass returns the class of an error of a scrape.
+func errorClass(err error) string {
+	if e, ok := err.(*scrapeError); ok {
+		return e.class
+	}
+	// Errors of gosnmp can only be told apart by their message.
+	msg := err.Error()
+	switch {
+	case isTimeout(err):
+		return errorTimeout
+	case strings.Contains(msg, "not authentic"):
+		return errorAuth
+	case strings.HasPrefix(msg, "Unable to decode"), strings.HasPrefix(msg, "Error parsing"),
+		strings.HasPrefix(msg, "Invalid SNMPV3"), strings.HasPrefix(msg, "Out of order response"):
+		return errorDecode
+	}
+	return errorOther
+}
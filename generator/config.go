@@ -15,6 +15,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/prometheus/snmp_exporter/config"
 )
@@ -28,6 +29,7 @@ type MetricOverrides struct {
 	Ignore         bool                              `yaml:"ignore,omitempty"`
 	RegexpExtracts map[string][]config.RegexpExtract `yaml:"regex_extracts,omitempty"`
 	Type           string                            `yaml:"type,omitempty"`
+	CacheTTL       time.Duration                     `yaml:"cache_ttl,omitempty"`
 }
 
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
@@ -46,13 +48,15 @@ func (c *MetricOverrides) UnmarshalYAML(unmarshal func(interface{}) error) error
 }
 
 type ModuleConfig struct {
-	Walk       []string                   `yaml:"walk"`
-	Lookups    []*Lookup                  `yaml:"lookups"`
-	WalkParams config.WalkParams          `yaml:",inline"`
-	Overrides  map[string]MetricOverrides `yaml:"overrides"`
+	Walk        []string                   `yaml:"walk"`
+	WalkColumns bool                       `yaml:"walk_columns"`
+	Lookups     []*Lookup                  `yaml:"lookups"`
+	WalkParams  config.WalkParams          `yaml:",inline"`
+	Overrides   map[string]MetricOverrides `yaml:"overrides"`
 }
 
 type Lookup struct {
-	OldIndex string `yaml:"old_index"`
-	NewIndex string `yaml:"new_index"`
+	OldIndex string        `yaml:"old_index"`
+	NewIndex string        `yaml:"new_index"`
+	CacheTTL time.Duration `yaml:"cache_ttl"`
 }
@@ -248,13 +248,19 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 
 	// Find all top-level nodes.
 	metricNodes := map[*Node]struct{}{}
+	// Subtrees of which only the columns and scalars of metrics are fetched.
+	columnSubtrees := map[*Node]struct{}{}
 	for _, oid := range toWalk {
 		metricNode, oidType := getMetricNode(oid, node, nameToNode)
 		switch oidType {
 		case oidNotFound:
 			log.Fatalf("Cannot find oid '%s' to walk", oid)
 		case oidSubtree:
-			needToWalk[oid] = struct{}{}
+			if cfg.WalkColumns {
+				columnSubtrees[metricNode] = struct{}{}
+			} else {
+				needToWalk[oid] = struct{}{}
+			}
 		case oidInstance:
 			// Add a trailing period to the OID to indicate a "Get" instead of a "Walk".
 			needToWalk[oid+"."] = struct{}{}
@@ -278,6 +284,7 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 
 	// Find all the usable metrics.
 	for _, metricNode := range metrics {
+		_, walkColumns := columnSubtrees[metricNode]
 		walkNode(metricNode, func(n *Node) {
 			t, ok := metricType(n.Type)
 			if !ok {
@@ -317,6 +324,13 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 				metric.Indexes = append(metric.Indexes, index)
 			}
 			out.Metrics = append(out.Metrics, metric)
+			if walkColumns {
+				if len(metric.Indexes) > 0 {
+					needToWalk[metric.Oid] = struct{}{}
+				} else {
+					needToWalk[metric.Oid+".0."] = struct{}{}
+				}
+			}
 		})
 	}
 
@@ -340,6 +354,7 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 						Labelname: sanitizeLabelName(indexNode.Label),
 						Type:      typ,
 						Oid:       indexNode.Oid,
+						CacheTTL:  lookup.CacheTTL,
 					})
 					// Make sure we walk the lookup OID(s).
 					if len(tableInstances[metric.Oid]) > 0 {
@@ -359,6 +374,7 @@ func generateConfigModule(cfg *ModuleConfig, node *Node, nameToNode map[string]*
 		for _, metric := range out.Metrics {
 			if name == metric.Name || name == metric.Oid {
 				metric.RegexpExtracts = params.RegexpExtracts
+				metric.CacheTTL = params.CacheTTL
 			}
 		}
 	}
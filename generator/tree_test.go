@@ -17,6 +17,7 @@ import (
 	"reflect"
 	"regexp"
 	"testing"
+	"time"
 
 	"github.com/prometheus/snmp_exporter/config"
 	yaml "gopkg.in/yaml.v2"
@@ -898,6 +899,58 @@ func TestGenerateConfigModule(t *testing.T) {
 				},
 			},
 		},
+		// Lookups and metrics with a cache_ttl.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Label: "octet",
+						Children: []*Node{
+							{Oid: "1.1.1", Label: "octetEntry", Indexes: []string{"octetIndex"},
+								Children: []*Node{
+									{Oid: "1.1.1.1", Access: "ACCESS_READONLY", Label: "octetIndex", Type: "INTEGER"},
+									{Oid: "1.1.1.2", Access: "ACCESS_READONLY", Label: "octetDesc", Type: "OCTETSTR"},
+									{Oid: "1.1.1.3", Access: "ACCESS_READONLY", Label: "octetFoo", Type: "INTEGER"}}}}}}},
+			cfg: &ModuleConfig{
+				Walk: []string{"octetFoo"},
+				Lookups: []*Lookup{
+					{
+						OldIndex: "octetIndex",
+						NewIndex: "1.1.1.2",
+						CacheTTL: time.Hour,
+					},
+				},
+				Overrides: map[string]MetricOverrides{
+					"octetFoo": MetricOverrides{CacheTTL: time.Minute},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1.1.1.2", "1.1.1.3"},
+				Metrics: []*config.Metric{
+					{
+						Name: "octetFoo",
+						Oid:  "1.1.1.3",
+						Help: " - 1.1.1.3",
+						Type: "gauge",
+						Indexes: []*config.Index{
+							{
+								Labelname: "octetDesc",
+								Type:      "gauge",
+							},
+						},
+						Lookups: []*config.Lookup{
+							{
+								Labels:    []string{"octetDesc"},
+								Labelname: "octetDesc",
+								Type:      "OctetString",
+								Oid:       "1.1.1.2",
+								CacheTTL:  time.Hour,
+							},
+						},
+						CacheTTL: time.Minute,
+					},
+				},
+			},
+		},
 		// Validate metric names.
 		{
 			node: &Node{Oid: "1", Label: "root",
@@ -1214,6 +1267,63 @@ func TestGenerateConfigModule(t *testing.T) {
 				},
 			},
 		},
+		// Only the columns of metrics walked, and scalars fetched.
+		{
+			node: &Node{Oid: "1", Label: "root",
+				Children: []*Node{
+					{Oid: "1.1", Access: "ACCESS_READONLY", Label: "scalar", Type: "INTEGER"},
+					{Oid: "1.2", Label: "table",
+						Children: []*Node{
+							{Oid: "1.2.1", Label: "tableEntry", Indexes: []string{"tableIndex"},
+								Children: []*Node{
+									{Oid: "1.2.1.1", Access: "ACCESS_NOACCESS", Label: "tableIndex", Type: "INTEGER"},
+									{Oid: "1.2.1.2", Access: "ACCESS_READONLY", Label: "tableFoo", Type: "INTEGER"},
+									{Oid: "1.2.1.3", Access: "ACCESS_READONLY", Label: "tableBar", Type: "INTEGER"},
+								}}}}}},
+			cfg: &ModuleConfig{
+				Walk:        []string{"root"},
+				WalkColumns: true,
+				Overrides: map[string]MetricOverrides{
+					"tableBar": {Ignore: true},
+				},
+			},
+			out: &config.Module{
+				Walk: []string{"1.2.1.1", "1.2.1.2"},
+				Get:  []string{"1.1.0"},
+				Metrics: []*config.Metric{
+					{
+						Name: "scalar",
+						Oid:  "1.1",
+						Type: "gauge",
+						Help: " - 1.1",
+					},
+					{
+						Name: "tableIndex",
+						Oid:  "1.2.1.1",
+						Type: "gauge",
+						Help: " - 1.2.1.1",
+						Indexes: []*config.Index{
+							{
+								Labelname: "tableIndex",
+								Type:      "gauge",
+							},
+						},
+					},
+					{
+						Name: "tableFoo",
+						Oid:  "1.2.1.2",
+						Type: "gauge",
+						Help: " - 1.2.1.2",
+						Indexes: []*config.Index{
+							{
+								Labelname: "tableIndex",
+								Type:      "gauge",
+							},
+						},
+					},
+				},
+			},
+		},
 	}
 	for i, c := range cases {
 		// Indexes and lookups always end up initilized.
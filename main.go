@@ -14,11 +14,15 @@
 package main
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	_ "net/http/pprof"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"syscall"
 	"time"
@@ -35,8 +39,48 @@ import (
 )
 
 var (
-	configFile    = kingpin.Flag("config.file", "Path to configuration file.").Default("snmp.yml").String()
-	listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9116").String()
+	configSource   = kingpin.Flag("config.source", "Where to load the configuration from. One of file, mysql or http.").Default("file").Enum("file", "mysql", "http")
+	configFile     = kingpin.Flag("config.file", "Path to configuration file, or a directory or glob of them.").Default("snmp.yml").String()
+	configURL      = kingpin.Flag("config.http.url", "URL to fetch the configuration from, used with --config.source=http.").String()
+	configTimeout  = kingpin.Flag("config.http.timeout", "Timeout for fetching the configuration over HTTP.").Default("10s").Duration()
+	mysqlDSN       = kingpin.Flag("config.mysql.dsn", "MySQL DSN to load the configuration from, used with --config.source=mysql.").Envar("SNMP_EXPORTER_MYSQL_DSN").String()
+	mysqlDSNFile   = kingpin.Flag("config.mysql.dsn-file", "File containing the MySQL DSN, used if --config.mysql.dsn is not set.").String()
+	mysqlTLSCA     = kingpin.Flag("config.mysql.tls.ca-file", "CA certificate to verify the MySQL server with.").String()
+	mysqlTLSCert   = kingpin.Flag("config.mysql.tls.cert-file", "Client certificate to present to the MySQL server.").String()
+	mysqlTLSKey    = kingpin.Flag("config.mysql.tls.key-file", "Key for the MySQL client certificate.").String()
+	mysqlTLSName   = kingpin.Flag("config.mysql.tls.server-name", "Server name to verify the MySQL server certificate against.").String()
+	mysqlTLSSkip   = kingpin.Flag("config.mysql.tls.insecure-skip-verify", "Do not verify the MySQL server certificate.").Bool()
+	mysqlMaxOpen   = kingpin.Flag("config.mysql.max-open-conns", "Maximum number of open connections to MySQL.").Default("2").Int()
+	mysqlMaxIdle   = kingpin.Flag("config.mysql.max-idle-conns", "Maximum number of idle connections to MySQL.").Default("1").Int()
+	mysqlLifetime  = kingpin.Flag("config.mysql.conn-max-lifetime", "Maximum time a MySQL connection is reused for.").Default("5m").Duration()
+	mysqlTimeout   = kingpin.Flag("config.mysql.timeout", "Timeout for connecting to MySQL and loading the configuration.").Default("10s").Duration()
+	mysqlKey       = kingpin.Flag("config.mysql.secret-key", "Base64 encoded 32 byte key the secrets of credential profiles are encrypted with.").Envar("SNMP_EXPORTER_SECRET_KEY").String()
+	mysqlKeyFile   = kingpin.Flag("config.mysql.secret-key-file", "File containing the key the secrets of credential profiles are encrypted with.").String()
+	timeoutOffset  = kingpin.Flag("snmp.timeout-offset", "Offset to subtract from the scrape timeout Prometheus sends, to leave time for returning the results.").Default("0.5s").Duration()
+	maxSessions    = kingpin.Flag("snmp.max-sessions-per-target", "Maximum number of sessions to a target that walk_concurrency may open across scrapes, 0 for no limit.").Default("4").Int()
+	maxWalks       = kingpin.Flag("snmp.max-walks-per-target", "Maximum number of scrapes walking a target at once, further ones wait for their turn, 0 for no limit.").Default("0").Int()
+	engineTTL      = kingpin.Flag("snmp.engine-cache-ttl", "How long the engine discovered by an SNMPv3 session is reused by later sessions to the target, 0 to discover it every scrape.").Default("10m").Duration()
+	tenantLabels   = kingpin.Flag("snmp.tenant-labels", "Add org and sys labels to the samples of scrapes made on behalf of a tenant.").Bool()
+	snapshotFile   = kingpin.Flag("config.snapshot-file", "File to save each successfully loaded configuration to, and to fall back to if the source cannot be loaded at startup.").String()
+	reloadInterval = kingpin.Flag("config.reload-interval", "How often to reload the configuration, 0 to only reload on SIGHUP or /-/reload.").Default("10s").Duration()
+	pollSource     = kingpin.Flag("poll.source", "Where to load the targets to poll in the background from, whose scrapes are then served the latest results. One of none, file or mysql.").Default("none").Enum("none", "file", "mysql")
+	pollFile       = kingpin.Flag("poll.targets-file", "File listing the targets to poll, used with --poll.source=file.").Default("targets.yml").String()
+	pollInterval   = kingpin.Flag("poll.interval", "How often to poll targets that set no interval.").Default("1m").Duration()
+	pollTimeout    = kingpin.Flag("poll.timeout", "Timeout of each poll, 0 for the interval of the target.").Default("0s").Duration()
+	pollWorkers    = kingpin.Flag("poll.workers", "Number of polls to run at once.").Default("10").Int()
+	pollMaxAge     = kingpin.Flag("poll.max-age", "Age beyond which the results of a poll are not served, 0 for no limit.").Default("5m").Duration()
+	listenAddress  = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9116").String()
+
+	runCommand       = kingpin.Command("run", "Run the exporter.").Default()
+	dbCommand        = kingpin.Command("db", "Manage the configuration database.")
+	dbMigrateCommand = dbCommand.Command("migrate", "Create or upgrade the tables of the configuration database.")
+
+	configCommand       = kingpin.Command("config", "Copy modules between config files and the configuration database.")
+	configImportCommand = configCommand.Command("import", "Upsert the modules of a config file into the configuration database.")
+	configImportFile    = configImportCommand.Arg("file", "Config file to import.").Required().ExistingFile()
+	configImportPrune   = configImportCommand.Flag("prune", "Delete the metrics of imported modules that are not in the file.").Bool()
+	configExportCommand = configCommand.Command("export", "Print the modules of the configuration database as a config file.")
+	configExportSecrets = configExportCommand.Flag("show-secrets", "Print the credentials instead of <secret>.").Bool()
 
 	// Metrics about the SNMP exporter itself.
 	snmpDuration = prometheus.NewSummaryVec(
@@ -52,6 +96,28 @@ var (
 			Help: "Errors in requests to the SNMP exporter",
 		},
 	)
+	configStale = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "snmp_exporter_config_stale",
+			Help: "Whether the configuration in use is a snapshot or the last reload failed.",
+		},
+		func() float64 {
+			if stale, _ := sc.Stale(); stale {
+				return 1
+			}
+			return 0
+		},
+	)
+	configAge = prometheus.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "snmp_exporter_config_age_seconds",
+			Help: "Seconds since the configuration in use was loaded from its source.",
+		},
+		func() float64 {
+			_, age := sc.Stale()
+			return age.Seconds()
+		},
+	)
 	sc = &SafeConfig{
 		C: &config.Config{},
 	}
@@ -61,6 +127,8 @@ var (
 func init() {
 	prometheus.MustRegister(snmpDuration)
 	prometheus.MustRegister(snmpRequestErrors)
+	prometheus.MustRegister(configStale)
+	prometheus.MustRegister(configAge)
 	prometheus.MustRegister(version.NewCollector("snmp_exporter"))
 }
 
@@ -71,24 +139,41 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		snmpRequestErrors.Inc()
 		return
 	}
-	moduleName := r.URL.Query().Get("module")
+	moduleName := moduleList(r.URL.Query().Get("module"))
 	if moduleName == "" {
 		moduleName = "if_mib"
 	}
-	sc.RLock()
-	module, ok := (*(sc.C))[moduleName]
-	sc.RUnlock()
-	if !ok {
-		http.Error(w, fmt.Sprintf("Unkown module '%s'", moduleName), 400)
+	org, sys, err := tenantFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		snmpRequestErrors.Inc()
+		return
+	}
+	// Targets polled in the background get the results of the latest poll.
+	if targetPoller != nil {
+		if t := targetPoller.lookup(scrapeKey(target, moduleName, org, sys)); t != nil {
+			t.serve(w, r)
+			return
+		}
+	}
+	module, err := resolveModule(moduleName, org, sys)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
+		snmpRequestErrors.Inc()
+		return
+	}
+	ctx, cancel, err := scrapeContext(r)
+	if err != nil {
+		http.Error(w, err.Error(), 400)
 		snmpRequestErrors.Inc()
 		return
 	}
+	defer cancel()
 	log.Debugf("Scraping target '%s' with module '%s'", target, moduleName)
 
 	start := time.Now()
 	registry := prometheus.NewRegistry()
-	collector := collector{target: target, module: module}
-	registry.MustRegister(collector)
+	registry.MustRegister(newCollector(ctx, target, moduleName, module, org, sys))
 	// Delegate http serving to Promethues client library, which will call collector.Collect.
 	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
 	h.ServeHTTP(w, r)
@@ -97,6 +182,109 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	log.Debugf("Scrape of target '%s' with module '%s' took %f seconds", target, moduleName, duration)
 }
 
+// moduleList returns a comma separated list of modules sorted and without
+// duplicates, so that the same modules in any order are scraped together and
+// observed under one label.
+func moduleList(moduleName string) string {
+	if !strings.Contains(moduleName, ",") {
+		return moduleName
+	}
+	names := strings.Split(moduleName, ",")
+	sort.Strings(names)
+	unique := names[:1]
+	for _, name := range names[1:] {
+		if name != unique[len(unique)-1] {
+			unique = append(unique, name)
+		}
+	}
+	return strings.Join(unique, ",")
+}
+
+// resolveModule returns the module to scrape, as seen by the tenant. Several
+// modules separated by commas are merged, to be scraped with a single walk.
+func resolveModule(moduleName string, org, sys int) (*config.Module, error) {
+	sc.RLock()
+	var module *config.Module
+	var err error
+	if strings.Contains(moduleName, ",") {
+		module, err = sc.C.Merge(strings.Split(moduleName, ","))
+	} else if module = (*(sc.C))[moduleName]; module == nil {
+		err = fmt.Errorf("Unkown module '%s'", moduleName)
+	}
+	sc.RUnlock()
+	if err != nil {
+		return nil, err
+	}
+	// Only scrape the metrics the tenant is allowed to see.
+	return module.ForTenant(org, sys), nil
+}
+
+// newCollector returns the collector scraping the target with the module.
+func newCollector(ctx context.Context, target, moduleName string, module *config.Module, org, sys int) collector {
+	return collector{
+		ctx:    ctx,
+		target: target,
+		module: module,
+		// Identical scrapes in flight at the same time share one walk.
+		key:    scrapeKey(target, moduleName, org, sys),
+		labels: scrapeLabels(org, sys),
+	}
+}
+
+// scrapeKey identifies the scrapes of a target with a module for a tenant.
+func scrapeKey(target, moduleName string, org, sys int) string {
+	return fmt.Sprintf("%s/%s/%d/%d", target, moduleName, org, sys)
+}
+
+// scrapeLabels returns the labels added to the samples of scrapes made on
+// behalf of a tenant, if any.
+func scrapeLabels(org, sys int) prometheus.Labels {
+	if !*tenantLabels || org == 0 {
+		return nil
+	}
+	return prometheus.Labels{"org": strconv.Itoa(org), "sys": strconv.Itoa(sys)}
+}
+
+// scrapeContext returns a context for the scrape that ends with the request,
+// or when the scrape timeout Prometheus sends less --snmp.timeout-offset
+// runs out.
+func scrapeContext(r *http.Request) (context.Context, context.CancelFunc, error) {
+	v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if v == "" {
+		ctx, cancel := context.WithCancel(r.Context())
+		return ctx, cancel, nil
+	}
+	seconds, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Invalid X-Prometheus-Scrape-Timeout-Seconds header '%s'", v)
+	}
+	timeout := time.Duration(seconds * float64(time.Second))
+	if timeout > *timeoutOffset {
+		timeout -= *timeoutOffset
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	return ctx, cancel, nil
+}
+
+// tenantFromRequest returns the org and sys the scrape is made on behalf of,
+// zero if not given.
+func tenantFromRequest(r *http.Request) (org, sys int, err error) {
+	if o := r.URL.Query().Get("org"); o != "" {
+		if org, err = strconv.Atoi(o); err != nil {
+			return 0, 0, fmt.Errorf("Invalid 'org' parameter '%s'", o)
+		}
+	}
+	if s := r.URL.Query().Get("sys"); s != "" {
+		if org == 0 {
+			return 0, 0, fmt.Errorf("'sys' parameter requires an 'org'")
+		}
+		if sys, err = strconv.Atoi(s); err != nil {
+			return 0, 0, fmt.Errorf("Invalid 'sys' parameter '%s'", s)
+		}
+	}
+	return org, sys, nil
+}
+
 func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 	switch r.Method {
 	case "POST":
@@ -114,63 +302,239 @@ func updateConfiguration(w http.ResponseWriter, r *http.Request) {
 type SafeConfig struct {
 	sync.RWMutex
 	C *config.Config
+	// SnapshotFile is where each successfully loaded config is saved, if set.
+	SnapshotFile string
+	// When the config in use was last loaded from its source.
+	loaded time.Time
+	// Whether the last load failed, or the config in use is a snapshot.
+	stale bool
+}
+
+func (sc *SafeConfig) ReloadConfig(source config.Source) (err error) {
+	start := time.Now()
+	record := reloadRecord{Time: start, Source: source.String()}
+	conf, err := source.Load()
+	// Sources that could load only part of the config still return it.
+	partial, _ := err.(*config.PartialError)
+	if err != nil && (partial == nil || conf == nil) {
+		log.Errorf("Error loading config from %s: %s", source, err)
+		sc.Lock()
+		sc.stale = true
+		sc.Unlock()
+		record.Duration = time.Since(start).Seconds()
+		record.Error = err.Error()
+		recordReload(record, nil)
+		return err
+	}
+	sc.Lock()
+	var old config.Config
+	if sc.C != nil {
+		old = *sc.C
+	}
+	updated, changes := config.Update(old, *conf)
+	if !changes.Empty() {
+		sc.C = &updated
+	}
+	current := sc.C
+	sc.loaded = time.Now()
+	sc.stale = partial != nil
+	// Snapshots are only taken of complete configs.
+	if sc.SnapshotFile != "" && partial == nil {
+		// Writing under the lock keeps /config from marshaling at the same time.
+		if err := sc.saveSnapshot(changes); err != nil {
+			log.Errorf("Error saving config snapshot %s: %s", sc.SnapshotFile, err)
+		}
+	}
+	sc.Unlock()
+	if changes.Empty() {
+		log.Debugf("Config from %s is unchanged", source)
+	} else {
+		log.Infof("Loaded config from %s, added modules %v, removed modules %v, modified modules %v",
+			source, changes.Added, changes.Removed, changes.Modified)
+	}
+	record.Duration = time.Since(start).Seconds()
+	record.Added, record.Removed, record.Modified = changes.Added, changes.Removed, changes.Modified
+	if partial != nil {
+		log.Errorf("Error loading part of the config from %s: %s", source, partial)
+		record.Error = partial.Error()
+		recordReload(record, current)
+		return partial
+	}
+	record.Success = true
+	recordReload(record, current)
+	return nil
 }
 
-func (sc *SafeConfig) ReloadConfig(configFile string) (err error) {
-	conf, err := config.LoadFile(configFile)
+// saveSnapshot writes the config in use to the snapshot file, or only bumps
+// its modification time if the config did not change. Must be called with
+// the lock held.
+func (sc *SafeConfig) saveSnapshot(changes config.Changes) error {
+	if changes.Empty() {
+		if err := config.TouchSnapshot(sc.SnapshotFile); err == nil {
+			return nil
+		}
+	}
+	return config.WriteSnapshot(*sc.C, sc.SnapshotFile)
+}
+
+// LoadSnapshot switches to the config saved in the snapshot file, to be used
+// until the source can be loaded again.
+func (sc *SafeConfig) LoadSnapshot() error {
+	conf, saved, err := config.LoadSnapshot(sc.SnapshotFile)
 	if err != nil {
-		log.Errorf("Error parsing config file: %s", err)
 		return err
 	}
 	sc.Lock()
 	sc.C = conf
+	sc.loaded = saved
+	sc.stale = true
 	sc.Unlock()
-	log.Infoln("Loaded config file")
+	recordModuleMetrics(conf)
+	log.Warnf("Using config snapshot %s saved at %s", sc.SnapshotFile, saved)
 	return nil
 }
 
+// Stale returns whether the config in use may be out of date, and how long
+// ago it was loaded from its source. The age is 0 until a config is loaded.
+func (sc *SafeConfig) Stale() (bool, time.Duration) {
+	sc.RLock()
+	defer sc.RUnlock()
+	if sc.loaded.IsZero() {
+		return sc.stale, 0
+	}
+	return sc.stale, time.Since(sc.loaded)
+}
+
+// newTargetSource returns the config.TargetSource selected on the command
+// line. The database the config is loaded from is shared.
+func newTargetSource(source config.Source) (config.TargetSource, error) {
+	switch *pollSource {
+	case "mysql":
+		if mysqlSource, ok := source.(*config.MySQLSource); ok {
+			return mysqlSource, nil
+		}
+		return newMySQLSource()
+	default:
+		return &config.TargetFile{Path: *pollFile}, nil
+	}
+}
+
+// reload reloads the config, and the targets to poll if any are.
+func reload(source config.Source) error {
+	err := sc.ReloadConfig(source)
+	if targetPoller != nil {
+		if pollErr := targetPoller.reload(); pollErr != nil {
+			log.Errorf("Error loading targets to poll from %s: %s", targetPoller.source, pollErr)
+			if err == nil {
+				err = pollErr
+			}
+		}
+	}
+	return err
+}
+
+// newConfigSource returns the config.Source selected on the command line.
+func newConfigSource() (config.Source, error) {
+	switch *configSource {
+	case "mysql":
+		return newMySQLSource()
+	case "http":
+		if *configURL == "" {
+			return nil, fmt.Errorf("--config.http.url must be set when loading the config over http")
+		}
+		return &config.HTTPSource{URL: *configURL, Timeout: *configTimeout}, nil
+	default:
+		return &config.FileSource{Path: *configFile}, nil
+	}
+}
+
 func main() {
 	log.AddFlags(kingpin.CommandLine)
 	kingpin.Version(version.Print("snmp_exporter"))
 	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+	switch kingpin.Parse() {
+	case dbMigrateCommand.FullCommand():
+		if err := migrateDB(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case configImportCommand.FullCommand():
+		if err := importConfig(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	case configExportCommand.FullCommand():
+		if err := exportConfig(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
 	log.Infoln("Starting snmp exporter", version.Info())
 	log.Infoln("Build context", version.BuildContext())
 
-	// Bail early if the config is bad.
-	var err error
-	sc.C, err = config.LoadFile(*configFile)
+	source, err := newConfigSource()
 	if err != nil {
-		log.Fatalf("Error parsing config file: %s", err)
+		log.Fatal(err)
+	}
+	sc.SnapshotFile = *snapshotFile
+	// Bail early if the config is bad and there is no snapshot to fall back to.
+	// If only part of the config loads, that part is used until a reload
+	// gets the rest.
+	err = sc.ReloadConfig(source)
+	if _, partial := err.(*config.PartialError); err != nil && !partial {
+		if sc.SnapshotFile == "" {
+			log.Fatalf("Error loading config from %s: %s", source, err)
+		}
+		if err := sc.LoadSnapshot(); err != nil {
+			log.Fatalf("Error loading config snapshot %s: %s", sc.SnapshotFile, err)
+		}
 	}
 	// Initilise metrics.
 	for module, _ := range *sc.C {
 		snmpDuration.WithLabelValues(module)
 	}
 
-	ticker := time.NewTicker(time.Second*10)
-	defer ticker.Stop()
+	if *pollSource != "none" {
+		if *pollInterval <= 0 || *pollWorkers < 1 {
+			log.Fatal("--poll.interval and --poll.workers must be positive")
+		}
+		targetSource, err := newTargetSource(source)
+		if err != nil {
+			log.Fatal(err)
+		}
+		targetPoller = newPoller(targetSource, *pollWorkers, *pollInterval)
+		if err := targetPoller.reload(); err != nil {
+			log.Fatalf("Error loading targets to poll from %s: %s", targetSource, err)
+		}
+	}
+
+	var tick <-chan time.Time
+	if *reloadInterval > 0 {
+		ticker := time.NewTicker(*reloadInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
 
-	hup := make(chan os.Signal)
+	hup := make(chan os.Signal, 1)
 	reloadCh = make(chan chan error)
 	signal.Notify(hup, syscall.SIGHUP)
 	go func() {
 		for {
 			select {
 			case <-hup:
-				if err := sc.ReloadConfig(*configFile); err != nil {
+				if err := reload(source); err != nil {
 					log.Errorf("Error reloading config: %s", err)
 				}
 			case rc := <-reloadCh:
-				if err := sc.ReloadConfig(*configFile); err != nil {
+				if err := reload(source); err != nil {
 					log.Errorf("Error reloading config: %s", err)
 					rc <- err
 				} else {
 					rc <- nil
 				}
-			case <- ticker.C:
-				if err := sc.ReloadConfig(*configFile); err != nil {
+			case <-tick:
+				if err := reload(source); err != nil {
 					log.Errorf("Error reloading config: %s", err)
 				}
 			}
@@ -180,6 +544,7 @@ func main() {
 	http.Handle("/metrics", promhttp.Handler())       // Normal metrics endpoint for SNMP exporter itself.
 	http.HandleFunc("/snmp", handler)                 // Endpoint to do SNMP scrapes.
 	http.HandleFunc("/-/reload", updateConfiguration) // Endpoint to reload configuration.
+	http.Handle("/-/reload/history", reloads)         // Recent reloads and their errors.
 
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
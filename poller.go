@@ -0,0 +1,271 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"hash/fnv"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/log"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+var (
+	pollTargets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "snmp_poll_targets",
+			Help: "Targets polled in the background.",
+		},
+	)
+	pollsSkipped = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "snmp_polls_skipped_total",
+			Help: "Polls of a target skipped because its previous poll had not finished.",
+		},
+	)
+
+	// Polls the targets of --poll.source, nil if there is none.
+	targetPoller *poller
+)
+
+func init() {
+	prometheus.MustRegister(pollTargets)
+	prometheus.MustRegister(pollsSkipped)
+}
+
+// poller scrapes targets in the background, each at its own interval, with
+// a fixed number of workers. Scrapes of the targets are served the results
+// of the latest poll.
+type poller struct {
+	source config.TargetSource
+	// The interval of targets that set none.
+	interval time.Duration
+	jobs     chan *polledTarget
+
+	mtx     sync.Mutex
+	targets map[string]*polledTarget
+}
+
+type polledTarget struct {
+	config.PollTarget
+	key      string
+	interval time.Duration
+	stop     chan struct{}
+	// Set while a poll is queued or running.
+	busy int32
+
+	mtx      sync.Mutex
+	families []*dto.MetricFamily
+	polled   time.Time
+}
+
+func newPoller(source config.TargetSource, workers int, interval time.Duration) *poller {
+	p := &poller{
+		source:   source,
+		interval: interval,
+		jobs:     make(chan *polledTarget),
+		targets:  map[string]*polledTarget{},
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for t := range p.jobs {
+				p.poll(t)
+				atomic.StoreInt32(&t.busy, 0)
+			}
+		}()
+	}
+	return p
+}
+
+// reload loads the targets from the source. Targets that are new or whose
+// interval changed start being polled, and removed ones stop. If the source
+// cannot be loaded the current targets are kept.
+func (p *poller) reload() error {
+	targets, err := p.source.LoadTargets()
+	if err != nil {
+		return err
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	polled := map[string]*polledTarget{}
+	for _, pt := range targets {
+		pt.Module = moduleList(pt.Module)
+		key := scrapeKey(pt.Target, pt.Module, pt.OrgID, pt.SysID)
+		if _, ok := polled[key]; ok {
+			log.Warnf("Target %s with module %s is listed twice in %s", pt.Target, pt.Module, p.source)
+			continue
+		}
+		interval := pt.Interval
+		if interval == 0 {
+			interval = p.interval
+		}
+		old, ok := p.targets[key]
+		if ok && old.interval == interval {
+			polled[key] = old
+			continue
+		}
+		t := &polledTarget{PollTarget: pt, key: key, interval: interval, stop: make(chan struct{})}
+		if ok {
+			close(old.stop)
+			t.families, t.polled = old.result()
+		}
+		polled[key] = t
+		go p.schedule(t)
+	}
+	for key, t := range p.targets {
+		if _, ok := polled[key]; !ok {
+			close(t.stop)
+		}
+	}
+	p.targets = polled
+	pollTargets.Set(float64(len(polled)))
+	return nil
+}
+
+// lookup returns the polled target with the key of a scrape, nil if the
+// target is not polled.
+func (p *poller) lookup(key string) *polledTarget {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	return p.targets[key]
+}
+
+// schedule queues a poll of the target every interval until it is stopped.
+// Polls start at an offset within the interval that depends on the target,
+// so that the targets are polled at a steady rate rather than all at once.
+// A poll is skipped if the previous one has not finished.
+func (p *poller) schedule(t *polledTarget) {
+	timer := time.NewTimer(pollOffset(t.key, t.interval))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-t.stop:
+		return
+	}
+	ticker := time.NewTicker(t.interval)
+	defer ticker.Stop()
+	for {
+		if atomic.CompareAndSwapInt32(&t.busy, 0, 1) {
+			select {
+			case p.jobs <- t:
+			case <-t.stop:
+				atomic.StoreInt32(&t.busy, 0)
+				return
+			}
+		} else {
+			log.Debugf("Skipping poll of target %s with module %s, the previous one has not finished", t.Target, t.Module)
+			pollsSkipped.Inc()
+		}
+		select {
+		case <-ticker.C:
+		case <-t.stop:
+			return
+		}
+	}
+}
+
+// pollOffset returns where within the interval the polls of the target with
+// the key start, spread evenly over the whole interval.
+func pollOffset(key string, interval time.Duration) time.Duration {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	// The hash as a fraction of 2^32 times the interval, multiplied by the
+	// high and low halves of the interval apart so that it cannot overflow.
+	sum, i := uint64(h.Sum32()), uint64(interval)
+	return time.Duration((i>>32)*sum + (i&0xffffffff)*sum>>32)
+}
+
+// poll scrapes the target and keeps the results. The poll is bounded by
+// --poll.timeout, or the interval of the target.
+func (p *poller) poll(t *polledTarget) {
+	module, err := resolveModule(t.Module, t.OrgID, t.SysID)
+	if err != nil {
+		log.Errorf("Error polling target %s: %s", t.Target, err)
+		return
+	}
+	timeout := *pollTimeout
+	if timeout <= 0 {
+		timeout = t.interval
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	log.Debugf("Polling target '%s' with module '%s'", t.Target, t.Module)
+
+	start := time.Now()
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(newCollector(ctx, t.Target, t.Module, module, t.OrgID, t.SysID))
+	families, err := registry.Gather()
+	if err != nil {
+		log.Errorf("Error gathering the metrics of target %s: %s", t.Target, err)
+		return
+	}
+	snmpDuration.WithLabelValues(t.Module).Observe(time.Since(start).Seconds())
+	t.mtx.Lock()
+	t.families = families
+	t.polled = time.Now()
+	t.mtx.Unlock()
+}
+
+// result returns the metrics of the latest poll, and when it finished. The
+// time is zero if the target was not polled yet.
+func (t *polledTarget) result() ([]*dto.MetricFamily, time.Time) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	return t.families, t.polled
+}
+
+// serve writes the metrics of the latest poll along with their age in
+// snmp_poll_age_seconds. Without a poll younger than --poll.max-age only
+// snmp_up is written, as 0.
+func (t *polledTarget) serve(w http.ResponseWriter, r *http.Request) {
+	families, polled := t.result()
+	age := time.Since(polled)
+	labels := scrapeLabels(t.OrgID, t.SysID)
+
+	registry := prometheus.NewRegistry()
+	gatherers := prometheus.Gatherers{registry}
+	if !polled.IsZero() {
+		registry.MustRegister(prometheus.NewGaugeFunc(
+			prometheus.GaugeOpts{
+				Name:        "snmp_poll_age_seconds",
+				Help:        "Seconds since the poll the results are from finished.",
+				ConstLabels: labels,
+			},
+			age.Seconds,
+		))
+	}
+	if !polled.IsZero() && (*pollMaxAge <= 0 || age <= *pollMaxAge) {
+		gatherers = append(gatherers, prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return families, nil
+		}))
+	} else {
+		log.Debugf("No recent poll of target '%s' with module '%s' to serve", t.Target, t.Module)
+		registry.MustRegister(prometheus.NewGauge(
+			prometheus.GaugeOpts{
+				Name:        "snmp_up",
+				Help:        "Whether the target could be scraped.",
+				ConstLabels: labels,
+			},
+		))
+	}
+	promhttp.HandlerFor(gatherers, promhttp.HandlerOpts{}).ServeHTTP(w, r)
+}
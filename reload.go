@@ -0,0 +1,137 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+var (
+	configReloadSuccess = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "snmp_exporter_config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful.",
+		},
+	)
+	configReloadSeconds = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "snmp_exporter_config_last_reload_success_timestamp_seconds",
+			Help: "Timestamp of the last successful configuration reload.",
+		},
+	)
+	configReloadDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "snmp_exporter_config_reload_duration_seconds",
+			Help: "Duration of configuration reloads, successful or not.",
+		},
+	)
+	configModuleMetrics = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "snmp_exporter_config_module_metrics",
+			Help: "Number of metrics each module of the configuration in use has.",
+		},
+		[]string{"module"},
+	)
+	reloads = newReloadHistory(20)
+)
+
+func init() {
+	prometheus.MustRegister(configReloadSuccess)
+	prometheus.MustRegister(configReloadSeconds)
+	prometheus.MustRegister(configReloadDuration)
+	prometheus.MustRegister(configModuleMetrics)
+}
+
+// reloadRecord is the outcome of one configuration reload.
+type reloadRecord struct {
+	Time     time.Time `json:"time"`
+	Source   string    `json:"source"`
+	Duration float64   `json:"duration_seconds"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+	Added    []string  `json:"added,omitempty"`
+	Removed  []string  `json:"removed,omitempty"`
+	Modified []string  `json:"modified,omitempty"`
+}
+
+// reloadHistory keeps the most recent reload records.
+type reloadHistory struct {
+	mtx     sync.Mutex
+	size    int
+	records []reloadRecord
+}
+
+func newReloadHistory(size int) *reloadHistory {
+	return &reloadHistory{size: size}
+}
+
+func (h *reloadHistory) add(r reloadRecord) {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	h.records = append(h.records, r)
+	if len(h.records) > h.size {
+		h.records = h.records[len(h.records)-h.size:]
+	}
+}
+
+// recent returns the records, newest first.
+func (h *reloadHistory) recent() []reloadRecord {
+	h.mtx.Lock()
+	defer h.mtx.Unlock()
+	recent := make([]reloadRecord, 0, len(h.records))
+	for i := len(h.records) - 1; i >= 0; i-- {
+		recent = append(recent, h.records[i])
+	}
+	return recent
+}
+
+// ServeHTTP lists the recent reloads as JSON.
+func (h *reloadHistory) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(h.recent()); err != nil {
+		http.Error(w, err.Error(), 500)
+	}
+}
+
+// recordReload updates the reload metrics and history. conf is the config
+// in use after the reload, nil if nothing could be loaded.
+func recordReload(record reloadRecord, conf *config.Config) {
+	configReloadDuration.Observe(record.Duration)
+	if record.Success {
+		configReloadSuccess.Set(1)
+		configReloadSeconds.SetToCurrentTime()
+	} else {
+		configReloadSuccess.Set(0)
+	}
+	if conf != nil {
+		recordModuleMetrics(conf)
+	}
+	reloads.add(record)
+}
+
+// recordModuleMetrics sets the number of metrics of each module of the config
+// in use.
+func recordModuleMetrics(conf *config.Config) {
+	configModuleMetrics.Reset()
+	for name, module := range *conf {
+		configModuleMetrics.WithLabelValues(name).Set(float64(len(module.Metrics)))
+	}
+}
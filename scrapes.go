@@ -0,0 +1,200 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	scrapesCoalesced = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "snmp_scrapes_coalesced_total",
+			Help: "Scrapes that shared the walk of an identical scrape already in flight.",
+		},
+	)
+	walksWaiting = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "snmp_target_walks_waiting",
+			Help: "Scrapes waiting for the number of walks of their target to drop below the limit.",
+		},
+	)
+	walkWait = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name: "snmp_target_walk_wait_seconds",
+			Help: "Time scrapes waited for the number of walks of their target to drop below the limit.",
+		},
+	)
+
+	// Scrapes in flight, and walks of each target.
+	scrapes     = newScrapeGroup()
+	targetWalks = newWalkLimiter()
+)
+
+func init() {
+	prometheus.MustRegister(scrapesCoalesced)
+	prometheus.MustRegister(walksWaiting)
+	prometheus.MustRegister(walkWait)
+}
+
+// scrapeGroup runs identical scrapes that are in flight at the same time
+// only once, and gives each the results.
+type scrapeGroup struct {
+	mtx     sync.Mutex
+	flights map[string]*scrapeFlight
+}
+
+type scrapeFlight struct {
+	done    chan struct{}
+	results ScrapeResults
+	err     error
+	// Scrapes still waiting for the results.
+	waiters int
+	cancel  context.CancelFunc
+	// When the scrape runs out of time, zero if never.
+	deadline time.Time
+}
+
+func newScrapeGroup() *scrapeGroup {
+	return &scrapeGroup{flights: map[string]*scrapeFlight{}}
+}
+
+// do returns the results of scrape, run unless a scrape with the same key is
+// in flight already. The scrape runs until the deadline of the first scrape,
+// or until none is waiting any more. A scrape whose ctx ends no earlier than
+// the scrape in flight, or that is the last one waiting for it, gets what it
+// fetched so far. Others whose ctx ends first get an error. The results are
+// shared, so must not be modified.
+func (g *scrapeGroup) do(ctx context.Context, key string, scrape func(context.Context) (ScrapeResults, error)) (ScrapeResults, error) {
+	g.mtx.Lock()
+	f, ok := g.flights[key]
+	if ok {
+		f.waiters++
+		scrapesCoalesced.Inc()
+	} else {
+		var flightCtx context.Context
+		var cancel context.CancelFunc
+		deadline, ok := ctx.Deadline()
+		if ok {
+			flightCtx, cancel = context.WithDeadline(context.Background(), deadline)
+		} else {
+			flightCtx, cancel = context.WithCancel(context.Background())
+		}
+		f = &scrapeFlight{done: make(chan struct{}), waiters: 1, cancel: cancel, deadline: deadline}
+		g.flights[key] = f
+		go func() {
+			defer cancel()
+			f.results, f.err = scrape(flightCtx)
+			g.mtx.Lock()
+			if g.flights[key] == f {
+				delete(g.flights, key)
+			}
+			g.mtx.Unlock()
+			close(f.done)
+		}()
+	}
+	g.mtx.Unlock()
+
+	select {
+	case <-f.done:
+		return f.results, f.err
+	case <-ctx.Done():
+	}
+	g.mtx.Lock()
+	f.waiters--
+	last := f.waiters == 0
+	if last {
+		// Nobody else wants the results, later scrapes start afresh.
+		f.cancel()
+		if g.flights[key] == f {
+			delete(g.flights, key)
+		}
+	}
+	g.mtx.Unlock()
+	// The scrape in flight is ending too, and returns what it fetched so far.
+	if deadline, ok := ctx.Deadline(); last || ok && !f.deadline.IsZero() && !f.deadline.After(deadline) {
+		<-f.done
+		return f.results, f.err
+	}
+	return ScrapeResults{}, &scrapeError{class: errorTimeout, msg: "Ran out of time waiting for an identical scrape in flight"}
+}
+
+// walkLimiter limits the number of scrapes walking each target at once.
+type walkLimiter struct {
+	mtx     sync.Mutex
+	targets map[string]*targetWalkSlots
+}
+
+type targetWalkSlots struct {
+	slots chan struct{}
+	// Scrapes holding or waiting for a slot.
+	users int
+}
+
+func newWalkLimiter() *walkLimiter {
+	return &walkLimiter{targets: map[string]*targetWalkSlots{}}
+}
+
+// acquire waits until fewer than max scrapes walk the target, or ctx ends.
+// It returns whether the scrape may walk, and if so a function to call once
+// it is done. With a max of 0 there is no limit.
+func (l *walkLimiter) acquire(ctx context.Context, target string, max int) (func(), bool) {
+	if max <= 0 {
+		return func() {}, true
+	}
+	l.mtx.Lock()
+	t, ok := l.targets[target]
+	if !ok {
+		t = &targetWalkSlots{slots: make(chan struct{}, max)}
+		l.targets[target] = t
+	}
+	t.users++
+	l.mtx.Unlock()
+
+	select {
+	case t.slots <- struct{}{}:
+	default:
+		walksWaiting.Inc()
+		start := time.Now()
+		acquired := false
+		select {
+		case t.slots <- struct{}{}:
+			acquired = true
+		case <-ctx.Done():
+		}
+		walksWaiting.Dec()
+		walkWait.Observe(time.Since(start).Seconds())
+		if !acquired {
+			l.leave(target, t)
+			return nil, false
+		}
+	}
+	return func() {
+		<-t.slots
+		l.leave(target, t)
+	}, true
+}
+
+func (l *walkLimiter) leave(target string, t *targetWalkSlots) {
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	t.users--
+	if t.users == 0 {
+		delete(l.targets, target)
+	}
+}
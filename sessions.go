@@ -0,0 +1,60 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import "sync"
+
+// Sessions open to each target, across scrapes.
+var targetSessions = newSessionCounter()
+
+// sessionCounter counts the SNMP sessions open to each target, so that
+// additional sessions for walking in parallel are only opened while a
+// target has room for them.
+type sessionCounter struct {
+	mtx  sync.Mutex
+	open map[string]int
+}
+
+func newSessionCounter() *sessionCounter {
+	return &sessionCounter{open: map[string]int{}}
+}
+
+// add counts a session the scrape cannot do without, whatever the limit.
+func (c *sessionCounter) add(target string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.open[target]++
+}
+
+// tryAdd counts a session if the target has fewer than max open, or max is
+// 0, and returns whether it did.
+func (c *sessionCounter) tryAdd(target string, max int) bool {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	if max > 0 && c.open[target] >= max {
+		return false
+	}
+	c.open[target]++
+	return true
+}
+
+// done uncounts a session added before.
+func (c *sessionCounter) done(target string) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+	c.open[target]--
+	if c.open[target] <= 0 {
+		delete(c.open, target)
+	}
+}
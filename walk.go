@@ -0,0 +1,283 @@
+// Copyright 2018 The Prometheus Authors
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/common/log"
+	"github.com/soniah/gosnmp"
+
+	"github.com/prometheus/snmp_exporter/config"
+)
+
+// The max_repetitions gosnmp uses for bulk walks when a module sets 0.
+const defaultMaxRepetitions = 50
+
+// Request sizes each target could not handle, across scrapes. They are
+// forgotten after an hour, so that targets get to try larger ones again.
+var targetRequestSizes = newRequestSizes(time.Hour)
+
+// requestSizes keeps the number of OIDs per request, as Get batch or bulk
+// repetitions, that worked for each target after larger ones failed.
+type requestSizes struct {
+	mtx   sync.Mutex
+	ttl   time.Duration
+	sizes map[string]requestSize
+}
+
+type requestSize struct {
+	size   int
+	shrunk time.Time
+}
+
+func newRequestSizes(ttl time.Duration) *requestSizes {
+	return &requestSizes{ttl: ttl, sizes: map[string]requestSize{}}
+}
+
+// limit returns max, or less if the target recently failed with max.
+func (s *requestSizes) limit(target string, max int) int {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	known, ok := s.sizes[target]
+	if !ok {
+		return max
+	}
+	if time.Since(known.shrunk) >= s.ttl {
+		delete(s.sizes, target)
+		return max
+	}
+	if known.size < max {
+		return known.size
+	}
+	return max
+}
+
+// shrink records that the target failed with requests of size, and returns
+// the size to retry with, half of it.
+func (s *requestSizes) shrink(target string, size int) int {
+	size /= 2
+	if size < 1 {
+		size = 1
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	if known, ok := s.sizes[target]; !ok || size < known.size || time.Since(known.shrunk) >= s.ttl {
+		s.sizes[target] = requestSize{size: size, shrunk: time.Now()}
+	}
+	return size
+}
+
+// tooLarge returns whether a request of size failed because the response
+// was too large for the target, and a smaller one may work. Timeouts count
+// only once the target has responded in the session, as an unreachable
+// target times out whatever the size.
+func tooLarge(ctx context.Context, packet *gosnmp.SnmpPacket, err error, size int, responded bool) bool {
+	if size <= 1 || ctx.Err() != nil {
+		return false
+	}
+	if err != nil {
+		return responded && isTimeout(err)
+	}
+	return packet.Error == gosnmp.TooBig
+}
+
+func isTimeout(err error) bool {
+	return strings.HasPrefix(err.Error(), "Request timeout")
+}
+
+// walkGroups groups the subtrees that are siblings, such as the columns of
+// a table, to be walked together. It returns the indexes of the subtrees in
+// each group. Groups are in the order of their first subtree, and have at
+// most max subtrees each.
+func walkGroups(subtrees []string, max int) [][]int {
+	groups := [][]int{}
+	open := map[string]int{}
+	for i, subtree := range subtrees {
+		parent := subtree
+		if dot := strings.LastIndex(subtree, "."); dot >= 0 {
+			parent = subtree[:dot]
+		}
+		if g, ok := open[parent]; ok && len(groups[g]) < max {
+			groups[g] = append(groups[g], i)
+			continue
+		}
+		open[parent] = len(groups)
+		groups = append(groups, []int{i})
+	}
+	return groups
+}
+
+// bulkWalk walks subtrees in lockstep, each GETBULK request carrying the
+// next OID of every subtree not yet finished. The repetitions are divided
+// among the subtrees, so responses are about as large as those of a single
+// subtree, and subtrees take turns if there are more than repetitions. Like
+// gosnmp's BulkWalk a subtree ends with the first OID outside of it, and one
+// whose very first OID is outside of it is fetched with a GET instead, as it
+// is a single OID such as the instance of a scalar. Unlike it, when the
+// target responds with tooBig or times out the repetitions are halved and
+// the request retried.
+func bulkWalk(ctx context.Context, snmp *gosnmp.GoSNMP, config *config.Module, target string, subtrees []string, walkFn func(subtree int, pdu gosnmp.SnmpPDU) error) error {
+	reps := int(config.WalkParams.MaxRepetitions)
+	if reps == 0 {
+		reps = defaultMaxRepetitions
+	}
+	reps = targetRequestSizes.limit(target, reps)
+
+	roots := make([]string, len(subtrees))
+	next := make([]string, len(subtrees))
+	for i, subtree := range subtrees {
+		roots[i] = subtree
+		if !strings.HasPrefix(subtree, ".") {
+			roots[i] = "." + subtree
+		}
+		next[i] = roots[i]
+	}
+	// The subtrees not finished yet, in the order of the request.
+	active := make([]int, len(subtrees))
+	for i := range active {
+		active[i] = i
+	}
+	responded := false
+	for len(active) > 0 {
+		if !setTimeout(ctx, snmp, config) {
+			return ctx.Err()
+		}
+		// With fewer repetitions than subtrees left, the subtrees take turns.
+		requested := active
+		if len(requested) > reps {
+			requested = requested[:reps]
+		}
+		oids := make([]string, len(requested))
+		for j, i := range requested {
+			oids[j] = next[i]
+		}
+		response, err := snmp.GetBulk(oids, 0, uint8(reps/len(requested)))
+		if tooLarge(ctx, response, err, reps, responded) {
+			reps = targetRequestSizes.shrink(target, reps)
+			log.Debugf("Response of target %q too large, retrying with max_repetitions %d", snmp.Target, reps)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		responded = true
+		if response.PDUType == gosnmp.Report && len(response.Variables) > 0 {
+			return reportError(snmp.Target, response)
+		}
+		// Unlike gosnmp's BulkWalk, fail on errors such as genErr instead of
+		// taking the response for the end of the subtrees.
+		if response.Error != gosnmp.NoError && response.Error != gosnmp.NoSuchName {
+			return statusError(snmp.Target, response.Error)
+		}
+
+		var finished map[int]bool
+		var leaves []int
+		if len(response.Variables) == 0 || response.Error == gosnmp.NoSuchName {
+			finished = map[int]bool{}
+			for _, i := range requested {
+				finished[i] = true
+			}
+		} else {
+			finished, leaves, err = splitBulk(response.Variables, requested, roots, next, walkFn)
+			if err != nil {
+				return err
+			}
+		}
+		if len(leaves) > 0 {
+			if !setTimeout(ctx, snmp, config) {
+				return ctx.Err()
+			}
+			if err := getLeaves(snmp, roots, leaves, walkFn); err != nil {
+				return err
+			}
+		}
+		// The subtrees just requested go to the back of the queue.
+		stillActive := append([]int{}, active[len(requested):]...)
+		for _, i := range requested {
+			if !finished[i] {
+				stillActive = append(stillActive, i)
+			}
+		}
+		active = stillActive
+	}
+	return nil
+}
+
+// splitBulk hands the varbinds of a lockstep GETBULK response to walkFn
+// along with their subtree, and advances next past them. The response has a
+// row of one varbind per requested subtree for each repetition. It returns
+// the subtrees that ended, and those among them whose first varbind was
+// already outside of them.
+func splitBulk(variables []gosnmp.SnmpPDU, requested []int, roots, next []string, walkFn func(subtree int, pdu gosnmp.SnmpPDU) error) (map[int]bool, []int, error) {
+	finished := map[int]bool{}
+	var leaves []int
+	for k, v := range variables {
+		i := requested[k%len(requested)]
+		if finished[i] {
+			continue
+		}
+		if v.Type == gosnmp.EndOfMibView || v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance {
+			finished[i] = true
+			continue
+		}
+		if !strings.HasPrefix(v.Name, roots[i]+".") {
+			finished[i] = true
+			if k < len(requested) && next[i] == roots[i] {
+				leaves = append(leaves, i)
+			}
+			continue
+		}
+		if v.Name == next[i] {
+			return nil, nil, fmt.Errorf("OID not increasing: %s", v.Name)
+		}
+		if err := walkFn(i, v); err != nil {
+			return nil, nil, err
+		}
+		next[i] = v.Name
+	}
+	return finished, leaves, nil
+}
+
+// getLeaves fetches the roots of subtrees that turned out to be single OIDs,
+// with one GET.
+func getLeaves(snmp *gosnmp.GoSNMP, roots []string, leaves []int, walkFn func(subtree int, pdu gosnmp.SnmpPDU) error) error {
+	oids := make([]string, len(leaves))
+	for j, i := range leaves {
+		oids[j] = roots[i]
+	}
+	response, err := snmp.Get(oids)
+	if err != nil {
+		return err
+	}
+	if response.PDUType == gosnmp.Report && len(response.Variables) > 0 {
+		return reportError(snmp.Target, response)
+	}
+	if response.Error != gosnmp.NoError {
+		return statusError(snmp.Target, response.Error)
+	}
+	for j, v := range response.Variables {
+		if j >= len(leaves) || v.Type == gosnmp.NoSuchObject || v.Type == gosnmp.NoSuchInstance || v.Type == gosnmp.EndOfMibView {
+			continue
+		}
+		if err := walkFn(leaves[j], v); err != nil {
+			return err
+		}
+	}
+	return nil
+}